@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log/slog"
 	"strconv"
 )
 
@@ -49,22 +48,6 @@ func isValidWorkloadType(t string) bool {
 	return false
 }
 
-// exportMap holds a map of NFS exports ids to their corresponding NFS exports paths
-type exportMap struct {
-	enabled  bool
-	pathByID map[int]string
-}
-
-// newExportMap creates a map of NFS export ids to their corresponding NFS exports paths
-func newExportMap(enabled bool) exportMap {
-	m := new(exportMap)
-	m.enabled = enabled
-	if enabled {
-		m.pathByID = make(map[int]string)
-	}
-	return *m
-}
-
 // types for the decoded fields and tags
 type ptFields map[string]any
 type ptTags map[string]string
@@ -94,25 +77,19 @@ func fieldsForPPStat(ppstat PPStatResult) ptFields {
 // match the original workload definition i.e.
 // export_id groupname local_address path protocol remote_address share_name username zone_name
 // squash some of the fields e.g. Username vs UserID vs UserSID
-func tagsForPPStat(ctx context.Context, ppstat PPStatResult, cluster *Cluster, exports exportMap) ptTags {
+func tagsForPPStat(ctx context.Context, ppstat PPStatResult, cluster *Cluster) ptTags {
 	tags := make(ptTags)
 
 	// NFS export id
 	if ppstat.ExportID != nil {
 		id := *ppstat.ExportID
 		tags["export_id"] = strconv.Itoa(id)
-		if exports.enabled {
-			path, found := exports.pathByID[id]
-			if !found {
-				var err error
-				path, err = cluster.GetExportPathByID(ctx, id)
-				if err != nil {
-					log.Error("failed to lookup export id", slog.Int("export_id", id), slog.Any("error", err))
-					path = "unknown (lookup failed)"
-				}
-				exports.pathByID[id] = path
+		if cluster != nil && cluster.exports != nil {
+			if export, found := cluster.exports.lookup(ctx, cluster, id); found {
+				tags["export_path"] = exportPathTag(export)
+			} else {
+				tags["export_path"] = lookupFailed
 			}
-			tags["export_path"] = path
 		}
 	}
 
@@ -120,9 +97,9 @@ func tagsForPPStat(ctx context.Context, ppstat PPStatResult, cluster *Cluster, e
 	if ppstat.GroupName != nil {
 		tags["groupname"] = fmt.Sprintf("GID:%s", *ppstat.GroupName)
 	} else if ppstat.GroupID != nil {
-		tags["groupname"] = fmt.Sprintf("GID:%d", *ppstat.GroupID)
+		identityTags(ctx, tags, cluster, ppstat, identityGroup, fmt.Sprintf("GID:%d", *ppstat.GroupID), "groupname", "group_id")
 	} else if ppstat.GroupSid != nil {
-		tags["groupname"] = fmt.Sprintf("SID:%s", *ppstat.GroupSid)
+		identityTags(ctx, tags, cluster, ppstat, identityGroup, fmt.Sprintf("SID:%s", *ppstat.GroupSid), "groupname", "group_id")
 	}
 
 	// local network name/address
@@ -152,22 +129,29 @@ func tagsForPPStat(ctx context.Context, ppstat PPStatResult, cluster *Cluster, e
 	// SMB share name
 	if ppstat.ShareName != nil {
 		tags["share_name"] = *ppstat.ShareName
+		if cluster != nil && cluster.shares != nil {
+			if share, found := cluster.shares.lookup(ctx, cluster, shareKeyForPPStat(ppstat)); found {
+				tags["share_path"] = share.Path
+			} else {
+				tags["share_path"] = lookupFailed
+			}
+		}
 	}
 
 	// associated user identity
 	if ppstat.Username != nil {
 		tags["username"] = *ppstat.Username
 	} else if ppstat.UserID != nil {
-		tags["username"] = fmt.Sprintf("UID:%d", *ppstat.UserID)
+		identityTags(ctx, tags, cluster, ppstat, identityUser, fmt.Sprintf("UID:%d", *ppstat.UserID), "username", "user_id")
 	} else if ppstat.UserSid != nil {
-		tags["username"] = fmt.Sprintf("SID:%s", *ppstat.UserSid)
+		identityTags(ctx, tags, cluster, ppstat, identityUser, fmt.Sprintf("SID:%s", *ppstat.UserSid), "username", "user_id")
 	}
 
 	// OneFS access zone
 	if ppstat.ZoneName != nil {
 		tags["zone_name"] = *ppstat.ZoneName
 	} else if ppstat.ZoneID != nil {
-		tags["zone_name"] = fmt.Sprintf("zone:%d", *ppstat.ZoneID)
+		tags["zone_name"] = zoneNameTag(ctx, cluster, *ppstat.ZoneID)
 	}
 
 	// If non-Null, this will be one of the five extra buckets:
@@ -199,3 +183,14 @@ func tagsForPPStat(ctx context.Context, ppstat PPStatResult, cluster *Cluster, e
 
 	return tags
 }
+
+// zoneNameTag returns the zone_name tag for a workload that only has a zone
+// id, using the cluster's zone cache if enabled
+func zoneNameTag(ctx context.Context, cluster *Cluster, id int) string {
+	if cluster != nil && cluster.zones != nil {
+		if zone, found := cluster.zones.lookup(ctx, cluster, id); found {
+			return zone.Name
+		}
+	}
+	return fmt.Sprintf("zone:%d", id)
+}
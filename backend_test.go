@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestIsValidWorkloadType(t *testing.T) {
@@ -22,27 +24,6 @@ func TestIsValidWorkloadType(t *testing.T) {
 	}
 }
 
-func TestNewExportMap(t *testing.T) {
-	t.Run("disabled", func(t *testing.T) {
-		m := newExportMap(false)
-		if m.enabled {
-			t.Error("expected disabled export map")
-		}
-		if m.pathByID != nil {
-			t.Error("expected nil pathByID for disabled map")
-		}
-	})
-	t.Run("enabled", func(t *testing.T) {
-		m := newExportMap(true)
-		if !m.enabled {
-			t.Error("expected enabled export map")
-		}
-		if m.pathByID == nil {
-			t.Error("expected non-nil pathByID for enabled map")
-		}
-	})
-}
-
 func TestFieldsForPPStat(t *testing.T) {
 	stat := PPStatResult{
 		BytesIn:      1,
@@ -86,10 +67,9 @@ func intPtr(i int) *int       { return &i }
 
 func TestTagsForPPStat(t *testing.T) {
 	ctx := context.Background()
-	noExports := newExportMap(false)
 
 	t.Run("empty stat yields empty tags", func(t *testing.T) {
-		tags := tagsForPPStat(ctx, PPStatResult{}, nil, noExports)
+		tags := tagsForPPStat(ctx, PPStatResult{}, nil)
 		if len(tags) != 0 {
 			t.Errorf("expected empty tags, got %v", tags)
 		}
@@ -97,7 +77,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("username string", func(t *testing.T) {
 		s := PPStatResult{Username: strPtr("alice")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["username"] != "alice" {
 			t.Errorf("username tag = %q, want %q", tags["username"], "alice")
 		}
@@ -105,7 +85,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("username from user_id", func(t *testing.T) {
 		s := PPStatResult{UserID: intPtr(1001)}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		want := "UID:1001"
 		if tags["username"] != want {
 			t.Errorf("username tag = %q, want %q", tags["username"], want)
@@ -114,7 +94,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("username from user_sid", func(t *testing.T) {
 		s := PPStatResult{UserSid: strPtr("S-1-5-21-1")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		want := "SID:S-1-5-21-1"
 		if tags["username"] != want {
 			t.Errorf("username tag = %q, want %q", tags["username"], want)
@@ -123,7 +103,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("groupname string", func(t *testing.T) {
 		s := PPStatResult{GroupName: strPtr("staff")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["groupname"] != "GID:staff" {
 			t.Errorf("groupname tag = %q, want GID:staff", tags["groupname"])
 		}
@@ -131,7 +111,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("groupname from group_id", func(t *testing.T) {
 		s := PPStatResult{GroupID: intPtr(20)}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		want := "GID:20"
 		if tags["groupname"] != want {
 			t.Errorf("groupname tag = %q, want %q", tags["groupname"], want)
@@ -140,7 +120,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("export_id without path lookup", func(t *testing.T) {
 		s := PPStatResult{ExportID: intPtr(42)}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["export_id"] != "42" {
 			t.Errorf("export_id tag = %q, want %q", tags["export_id"], "42")
 		}
@@ -151,7 +131,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("local_address from local_name", func(t *testing.T) {
 		s := PPStatResult{LocalName: strPtr("node1.local")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["local_address"] != "node1.local" {
 			t.Errorf("local_address = %q, want %q", tags["local_address"], "node1.local")
 		}
@@ -159,7 +139,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("local_address fallback to local_address field", func(t *testing.T) {
 		s := PPStatResult{LocalAddress: strPtr("192.168.1.1")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["local_address"] != "192.168.1.1" {
 			t.Errorf("local_address = %q, want %q", tags["local_address"], "192.168.1.1")
 		}
@@ -167,7 +147,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("zone_name string", func(t *testing.T) {
 		s := PPStatResult{ZoneName: strPtr("System")}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["zone_name"] != "System" {
 			t.Errorf("zone_name = %q, want %q", tags["zone_name"], "System")
 		}
@@ -175,7 +155,7 @@ func TestTagsForPPStat(t *testing.T) {
 
 	t.Run("zone_name from zone_id", func(t *testing.T) {
 		s := PPStatResult{ZoneID: intPtr(3)}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		want := "zone:" + strconv.Itoa(3)
 		if tags["zone_name"] != want {
 			t.Errorf("zone_name = %q, want %q", tags["zone_name"], want)
@@ -187,7 +167,7 @@ func TestTagsForPPStat(t *testing.T) {
 			Protocol:  strPtr("smb2"),
 			ShareName: strPtr("homes"),
 		}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["protocol"] != "smb2" {
 			t.Errorf("protocol = %q, want smb2", tags["protocol"])
 		}
@@ -201,7 +181,7 @@ func TestTagsForPPStat(t *testing.T) {
 			WorkloadType: strPtr(wSystem),
 			WorkloadID:   intPtr(7),
 		}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["workload_type"] != wSystem {
 			t.Errorf("workload_type = %q, want %q", tags["workload_type"], wSystem)
 		}
@@ -216,9 +196,159 @@ func TestTagsForPPStat(t *testing.T) {
 			Username: strPtr("bob"),
 			UserID:   intPtr(999),
 		}
-		tags := tagsForPPStat(ctx, s, nil, noExports)
+		tags := tagsForPPStat(ctx, s, nil)
 		if tags["username"] != "bob" {
 			t.Errorf("username = %q, want bob (Username should take priority over UserID)", tags["username"])
 		}
 	})
 }
+
+func TestTagsForPPStatExportLookup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	c.exports = newExportCache(time.Hour)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	listings := func() int { return f.hitCount(http.MethodGet, zonesPath) }
+
+	tags := tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(2)}, c)
+	if tags["export_path"] != "/ifs/data/scratch,/ifs/data/scratch2" {
+		t.Errorf("export_path = %q, want both paths", tags["export_path"])
+	}
+	// exports in other zones were loaded by the same listing
+	tags = tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(3)}, c)
+	if tags["export_path"] != "/ifs/tenant/data" {
+		t.Errorf("export_path = %q, want %q", tags["export_path"], "/ifs/tenant/data")
+	}
+	if got := listings(); got != 1 {
+		t.Errorf("export listings = %d, want 1", got)
+	}
+
+	t.Run("unknown export is retried", func(t *testing.T) {
+		tags := tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(4)}, c)
+		if tags["export_path"] != lookupFailed {
+			t.Errorf("export_path = %q for unknown export", tags["export_path"])
+		}
+		f.setJSON(exportPath+"?zone=Tenant", map[string]any{
+			"exports": []NFSExport{{ID: 4, Paths: []string{"/ifs/tenant/new"}}},
+		})
+		c.exports.attempted = time.Time{}
+		tags = tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(4)}, c)
+		if tags["export_path"] != "/ifs/tenant/new" {
+			t.Errorf("export_path = %q after export was created", tags["export_path"])
+		}
+	})
+
+	t.Run("refresh on TTL", func(t *testing.T) {
+		f.setJSON(exportPath+"?zone=System", map[string]any{
+			"exports": []NFSExport{{ID: 1, Paths: []string{"/ifs/data/renamed"}}},
+		})
+		before := listings()
+		c.exports.refreshed = time.Now().Add(-2 * time.Hour)
+		c.exports.attempted = c.exports.refreshed
+		tags := tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(1)}, c)
+		if tags["export_path"] != "/ifs/data/renamed" {
+			t.Errorf("export_path = %q after TTL expiry", tags["export_path"])
+		}
+		if got := listings() - before; got != 1 {
+			t.Errorf("export listings = %d, want 1", got)
+		}
+	})
+
+	t.Run("failed refresh keeps cache", func(t *testing.T) {
+		f.inject(fakeFault{Path: exportPath, Count: -1, Status: http.StatusForbidden})
+		c.exports.refreshed = time.Now().Add(-2 * time.Hour)
+		c.exports.attempted = c.exports.refreshed
+		tags := tagsForPPStat(ctx, PPStatResult{ExportID: intPtr(1)}, c)
+		if tags["export_path"] != "/ifs/data/renamed" {
+			t.Errorf("export_path = %q after failed refresh", tags["export_path"])
+		}
+	})
+}
+
+func TestTagsForPPStatShareLookup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	c.shares = newShareCache(time.Hour)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		stat  PPStatResult
+		path  string
+		valid bool
+	}{
+		{"no zone", PPStatResult{ShareName: strPtr("Projects")}, "/ifs/data/projects", true},
+		{"case-insensitive", PPStatResult{ShareName: strPtr("HOME")}, "/ifs/data/home", true},
+		{"zone name", PPStatResult{ShareName: strPtr("projects"), ZoneName: strPtr("Tenant")}, "/ifs/tenant/projects", true},
+		{"zone id", PPStatResult{ShareName: strPtr("projects"), ZoneID: intPtr(2)}, "/ifs/tenant/projects", true},
+		{"unknown share", PPStatResult{ShareName: strPtr("home"), ZoneName: strPtr("Tenant")}, lookupFailed, true},
+		{"no share", PPStatResult{ZoneName: strPtr("Tenant")}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := tagsForPPStat(ctx, tt.stat, c)
+			path, ok := tags["share_path"]
+			if ok != tt.valid || path != tt.path {
+				t.Errorf("share_path = %q (set %v), want %q (set %v)", path, ok, tt.path, tt.valid)
+			}
+		})
+	}
+	if got := f.hitCount(http.MethodGet, smbSharePath); got != 2 {
+		t.Errorf("share list requests = %d, want 2 (one per zone)", got)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c.shares = nil
+		tags := tagsForPPStat(ctx, PPStatResult{ShareName: strPtr("Projects")}, c)
+		if _, ok := tags["share_path"]; ok {
+			t.Error("share_path should not be set when share lookup is disabled")
+		}
+	})
+}
+
+func TestTagsForPPStatZoneLookup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	c.zones = newZoneCache(time.Hour)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	tags := tagsForPPStat(ctx, PPStatResult{ZoneID: intPtr(2)}, c)
+	if tags["zone_name"] != "Tenant" {
+		t.Errorf("zone_name = %q, want %q", tags["zone_name"], "Tenant")
+	}
+	tags = tagsForPPStat(ctx, PPStatResult{ZoneID: intPtr(1)}, c)
+	if tags["zone_name"] != "System" {
+		t.Errorf("zone_name = %q, want %q", tags["zone_name"], "System")
+	}
+	if got := f.hitCount(http.MethodGet, zonesPath); got != 1 {
+		t.Errorf("zone list requests = %d, want 1", got)
+	}
+	// a zone name from the workload takes precedence
+	tags = tagsForPPStat(ctx, PPStatResult{ZoneID: intPtr(2), ZoneName: strPtr("Other")}, c)
+	if tags["zone_name"] != "Other" {
+		t.Errorf("zone_name = %q, want %q", tags["zone_name"], "Other")
+	}
+
+	t.Run("lookup failure", func(t *testing.T) {
+		f := newFakePAPI(t)
+		c := f.cluster(authtypeBasic)
+		c.zones = newZoneCache(time.Hour)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		f.inject(fakeFault{Path: zonesPath, Count: -1, Status: http.StatusForbidden})
+		tags := tagsForPPStat(ctx, PPStatResult{ZoneID: intPtr(2)}, c)
+		if tags["zone_name"] != "zone:2" {
+			t.Errorf("zone_name = %q, want %q", tags["zone_name"], "zone:2")
+		}
+	})
+}
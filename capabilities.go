@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const platformLatestPath = "/platform/latest"
+const perfSettingsPath = "/platform/10/performance/settings"
+
+// minPPAPIVersion is the first platform API version (OneFS 8.2) with
+// partitioned performance datasets and workload statistics
+const minPPAPIVersion = 7
+
+// minAPIVersions gives the first platform API version that supports each
+// resource we use, keyed by path prefix below /platform/<version>/. Resources
+// not listed are available in every version.
+var minAPIVersions = map[string]int{
+	"performance/":                minPPAPIVersion,
+	"statistics/summary/workload": minPPAPIVersion,
+}
+
+// errUnsupportedAPI is returned for requests that the cluster's OneFS release
+// does not support
+var errUnsupportedAPI = errors.New("not supported by this OneFS release")
+
+// Capabilities describes what the cluster's platform API supports
+type Capabilities struct {
+	APIVersion             int  // latest platform API version supported by the cluster
+	PartitionedPerformance bool // performance datasets and workload statistics
+}
+
+// PerformanceSettings holds the numeric partitioned performance settings of
+// the cluster, such as max_dataset_count and top_n_collection_count, keyed by
+// setting name
+type PerformanceSettings map[string]float64
+
+// GetPerformanceSettings returns the cluster's partitioned performance settings
+func (c *Cluster) GetPerformanceSettings(ctx context.Context) (PerformanceSettings, error) {
+	res, err := c.restGet(ctx, perfSettingsPath)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Settings map[string]any `json:"settings"`
+	}
+	if err := json.Unmarshal(res, &resp); err != nil {
+		return nil, fmt.Errorf("unable to parse response for %s: %w", perfSettingsPath, err)
+	}
+	settings := make(PerformanceSettings)
+	for k, v := range resp.Settings {
+		if f, ok := v.(float64); ok {
+			settings[k] = f
+		}
+	}
+	return settings, nil
+}
+
+// GetCapabilities probes the cluster's platform API version and derives the
+// set of features the collector can use
+func (c *Cluster) GetCapabilities(ctx context.Context) (*Capabilities, error) {
+	res, err := c.restGet(ctx, platformLatestPath)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			// /platform/latest predates partitioned performance
+			return &Capabilities{}, nil
+		}
+		return nil, err
+	}
+	var latest struct {
+		Latest string `json:"latest"`
+	}
+	if err := json.Unmarshal(res, &latest); err != nil {
+		return nil, fmt.Errorf("unable to parse response for %s: %w", platformLatestPath, err)
+	}
+	// the version may have a minor component, e.g. "3.1"
+	major, _, _ := strings.Cut(latest.Latest, ".")
+	version, err := strconv.Atoi(major)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected platform API version %q", latest.Latest)
+	}
+	caps := &Capabilities{APIVersion: version}
+	caps.PartitionedPerformance = version >= minPPAPIVersion
+	return caps, nil
+}
+
+// checkCapabilities probes the cluster's capabilities and records them so
+// that API requests use versions the cluster supports. It fails if the
+// cluster does not support partitioned performance at all.
+func (c *Cluster) checkCapabilities(ctx context.Context) error {
+	caps, err := c.GetCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+	if caps.PartitionedPerformance {
+		settings, err := c.GetPerformanceSettings(ctx)
+		if err != nil {
+			log.Warn("Unable to read partitioned performance settings for cluster",
+				slog.String("cluster", c.ClusterName),
+				slog.Any("error", err))
+		} else {
+			c.perfSettings = settings
+		}
+	}
+	c.caps = caps
+	log.Info("Detected cluster API capabilities",
+		slog.String("cluster", c.ClusterName),
+		slog.String("onefs_version", c.OSVersion),
+		slog.Int("api_version", caps.APIVersion),
+		slog.Bool("partitioned_performance", caps.PartitionedPerformance))
+	if !caps.PartitionedPerformance {
+		return fmt.Errorf("cluster %s runs OneFS %s (platform API version %d) but partitioned performance requires OneFS 8.2 or later (API version %d): %w",
+			c.ClusterName, c.OSVersion, caps.APIVersion, minPPAPIVersion, errUnsupportedAPI)
+	}
+	return nil
+}
+
+// performanceSettingStats returns the cluster's performance settings as
+// performance_setting stats
+func (c *Cluster) performanceSettingStats() []ClusterStat {
+	now := time.Now().Unix()
+	stats := make([]ClusterStat, 0, len(c.perfSettings))
+	for name, value := range c.perfSettings {
+		stats = append(stats, ClusterStat{
+			Name:  "performance_setting",
+			Tags:  map[string]string{"setting": name},
+			Value: value,
+			Time:  now,
+		})
+	}
+	return stats
+}
+
+// apiPath returns path with its platform API version lowered to the latest
+// version the cluster supports, if that is older. It fails if the cluster's
+// API is too old for the resource. Before the capabilities are known, or for
+// paths outside /platform/<version>/, path is returned unchanged.
+func (c *Cluster) apiPath(path string) (string, error) {
+	if c.caps == nil {
+		return path, nil
+	}
+	rest, ok := strings.CutPrefix(path, "/platform/")
+	if !ok {
+		return path, nil
+	}
+	v, resource, ok := strings.Cut(rest, "/")
+	version, err := strconv.Atoi(v)
+	if !ok || err != nil || version <= c.caps.APIVersion {
+		return path, nil
+	}
+	for prefix, minVersion := range minAPIVersions {
+		if strings.HasPrefix(resource, prefix) && c.caps.APIVersion < minVersion {
+			return "", fmt.Errorf("%s requires platform API version %d, cluster %s supports %d: %w",
+				path, minVersion, c.name(), c.caps.APIVersion, errUnsupportedAPI)
+		}
+	}
+	return "/platform/" + strconv.Itoa(c.caps.APIVersion) + "/" + resource, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClusterCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("current", func(t *testing.T) {
+		f := newFakePAPI(t)
+		c := f.cluster(authtypeBasic)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		want := Capabilities{APIVersion: 16, PartitionedPerformance: true}
+		if c.caps == nil || *c.caps != want {
+			t.Errorf("capabilities = %+v, want %+v", c.caps, want)
+		}
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, dsPath); got != 1 {
+			t.Errorf("requests for %s = %d, want 1", dsPath, got)
+		}
+		if got := c.perfSettings["top_n_collection_count"]; got != 8 {
+			t.Errorf("top_n_collection_count = %v, want 8", got)
+		}
+		stats := c.performanceSettingStats()
+		if len(stats) != 6 {
+			t.Errorf("performance setting stats = %d, want 6", len(stats))
+		}
+		for _, stat := range stats {
+			if stat.Name != "performance_setting" || stat.Value != c.perfSettings[stat.Tags["setting"]] {
+				t.Errorf("unexpected performance setting stat %+v", stat)
+			}
+		}
+	})
+
+	t.Run("no performance settings", func(t *testing.T) {
+		f := newFakePAPI(t)
+		f.inject(fakeFault{Path: perfSettingsPath, Count: -1, Status: http.StatusForbidden})
+		c := f.cluster(authtypeBasic)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if stats := c.performanceSettingStats(); len(stats) != 0 {
+			t.Errorf("performance setting stats = %v, want none", stats)
+		}
+	})
+
+	t.Run("older API version", func(t *testing.T) {
+		f := newFakePAPI(t)
+		f.setJSON(platformLatestPath, map[string]string{"latest": "8"})
+		f.loadFixture("/platform/8/performance/datasets", "datasets.json")
+		c := f.cluster(authtypeBasic)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, "/platform/8/performance/datasets"); got != 1 {
+			t.Errorf("requests for version 8 datasets = %d, want 1", got)
+		}
+		// resources available in every version keep the version we ask for
+		if _, err := c.GetExports(ctx, ""); err != nil {
+			t.Fatalf("GetExports failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, exportPath); got == 0 {
+			t.Errorf("no requests for %s", exportPath)
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		fault fakeFault
+	}{
+		{"too old", fakeFault{Path: platformLatestPath, Count: -1, Status: http.StatusOK, Body: `{"latest":"5"}`}},
+		{"no latest endpoint", fakeFault{Path: platformLatestPath, Count: -1, Status: http.StatusNotFound}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakePAPI(t)
+			f.inject(tt.fault)
+			c := f.cluster(authtypeBasic)
+			if err := c.Connect(ctx); !errors.Is(err, errUnsupportedAPI) {
+				t.Errorf("Connect error = %v, want %v", err, errUnsupportedAPI)
+			}
+		})
+	}
+}
+
+func TestAPIPath(t *testing.T) {
+	c := &Cluster{ClusterName: "test"}
+	if got, err := c.apiPath(dsPath); err != nil || got != dsPath {
+		t.Errorf("apiPath before probing = %q, %v, want %q", got, err, dsPath)
+	}
+	c.caps = &Capabilities{APIVersion: 5}
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{exportPath + "?zone=Tenant", exportPath + "?zone=Tenant", false},
+		{"/platform/12/cluster/config", "/platform/5/cluster/config", false},
+		{dsPath, "", true},
+		{ppWorkloadPath + "?dataset=System", "", true},
+		{sessionPath, sessionPath, false},
+		{platformLatestPath, platformLatestPath, false},
+	}
+	for _, tt := range tests {
+		got, err := c.apiPath(tt.path)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("apiPath(%q) = %q, %v, want %q (error %v)", tt.path, got, err, tt.want, tt.err)
+		}
+		if err != nil && !errors.Is(err, errUnsupportedAPI) {
+			t.Errorf("apiPath(%q) error = %v, want %v", tt.path, err, errUnsupportedAPI)
+		}
+	}
+}
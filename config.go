@@ -5,7 +5,10 @@ package main
 import (
 	"fmt"
 	"math"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -14,14 +17,39 @@ import (
 // If not overridden, we will only poll every minUpdateInterval seconds
 const defaultMinUpdateInterval = 30
 
+// Default interval between polls of each cluster, in seconds
+const defaultPollInterval = PPSampleRate
+
 // Default retry limit
 const defaultMaxRetries = 8
+
+// Default API retry backoff limits, in seconds
+const defaultRetryInitialIntvl = 1
+const defaultRetryMaxIntvl = 1800
 const processorDefaultMaxRetries = 8
 const processorDefaultRetryIntvl = 5
 
 // Default Normalizaion of ClusterNames
 const defaultPreserveCase = false
 
+// Default limit on concurrent workload queries per cluster in per-node mode
+const defaultNodeConcurrency = 4
+
+// Default limit on concurrently collected datasets per cluster
+const defaultDatasetConcurrency = 4
+
+// Default OneFS API connection settings; timeouts are in seconds
+const (
+	defaultAPIPort             = 8080
+	defaultAPIScheme           = "https"
+	defaultConnectTimeout      = 10
+	defaultTLSHandshakeTimeout = 10
+	defaultRequestTimeout      = 120
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 2
+	defaultIdleConnTimeout     = 90
+)
+
 // config file structures
 type tomlConfig struct {
 	Global     globalConfig
@@ -31,6 +59,11 @@ type tomlConfig struct {
 	Prometheus prometheusConfig `toml:"prometheus"`
 	PromSD     promSdConf       `toml:"prom_http_sd"`
 	Clusters   []clusterConf    `toml:"cluster"`
+	Routes     []routeConfig    `toml:"route"`
+
+	// named back end instances, from [influxdb.<name>] and [influxdbv2.<name>] sections
+	InfluxDBInstances   map[string]influxDBConfig   `toml:"-"`
+	InfluxDBv2Instances map[string]influxDBv2Config `toml:"-"`
 }
 
 type loggingConfig struct {
@@ -41,14 +74,47 @@ type loggingConfig struct {
 }
 
 type globalConfig struct {
-	Version             string  `toml:"version"`
-	Processor           string  `toml:"stats_processor"`
-	ProcessorMaxRetries int     `toml:"stats_processor_max_retries"`
-	ProcessorRetryIntvl int     `toml:"stats_processor_retry_interval"`
-	MinUpdateInvtl      int     `toml:"min_update_interval_override"`
-	MaxRetries          int     `toml:"max_retries"`
-	LookupExportIDs     bool    `toml:"lookup_export_ids"`
-	PreserveCase        bool    `toml:"preserve_case"` // enable/disable normalization of Cluster Names
+	Version             string   `toml:"version"`
+	Processor           string   `toml:"stats_processor"`
+	Processors          []string `toml:"stats_processors"` // several back ends to write to, instead of stats_processor
+	ProcessorMaxRetries int      `toml:"stats_processor_max_retries"`
+	ProcessorRetryIntvl int      `toml:"stats_processor_retry_interval"`
+	MinUpdateInvtl      int      `toml:"min_update_interval_override"`
+	PollInterval        int      `toml:"poll_interval"` // how often each cluster is polled, in seconds
+	MaxRetries          int      `toml:"max_retries"`
+	RetryInitialIntvl   int      `toml:"retry_initial_interval"` // delay before the first API retry, in seconds
+	RetryMaxIntvl       int      `toml:"retry_max_interval"`     // upper limit on the delay between API retries, in seconds
+	LookupExportIDs     bool     `toml:"lookup_export_ids"`
+	LookupShareNames    bool     `toml:"lookup_share_names"`
+	LookupZoneIDs       bool     `toml:"lookup_zone_ids"`
+	LookupIdentities    bool     `toml:"lookup_identities"`
+	IdentityCacheSize   int      `toml:"identity_cache_size"` // maximum number of cached user and group names per cluster
+	IdentityCacheTTL    int      `toml:"identity_cache_ttl"`  // how long a user or group name is cached, in seconds
+	LookupCacheTTL      int      `toml:"lookup_cache_ttl"`    // how often the NFS export, SMB share and zone caches are reloaded, in seconds
+	PreserveCase        bool     `toml:"preserve_case"`       // enable/disable normalization of Cluster Names
+	ReuseSessions       bool     `toml:"reuse_sessions"`      // keep cluster sessions across config reloads
+	PerNodeCollection   bool     `toml:"per_node_collection"` // query each node separately and report missing nodes
+	NodeConcurrency     int      `toml:"node_concurrency"`    // maximum concurrent per-node queries per cluster
+	DatasetConcurrency  int      `toml:"dataset_concurrency"` // maximum concurrently collected datasets per cluster
+	IncludeDatasets     []string `toml:"include_datasets"`    // if set, only collect datasets matching one of these name/id patterns
+	ExcludeDatasets     []string `toml:"exclude_datasets"`    // never collect datasets matching one of these name/id patterns
+	SpoolDir            string   `toml:"spool_dir"`           // if set, spool batches that fail to write here for replay
+	SpoolMaxSize        int      `toml:"spool_max_size"`      // limit on the size of each spool, in MiB
+	SpoolMaxAge         int      `toml:"spool_max_age"`       // spooled batches older than this are dropped, in seconds
+	apiConnConfig                // defaults for the per-cluster API connection settings
+}
+
+// apiConnConfig holds the OneFS API connection settings. They may be set in the
+// [global] section and overridden for each cluster. Timeouts are in seconds.
+type apiConnConfig struct {
+	APIPort             *int    `toml:"api_port"`                // PAPI port, normally 8080
+	APIScheme           *string `toml:"api_scheme"`              // "https" (default) or "http"
+	ConnectTimeout      *int    `toml:"connect_timeout"`         // TCP connect timeout
+	TLSHandshakeTimeout *int    `toml:"tls_handshake_timeout"`   // TLS handshake timeout
+	RequestTimeout      *int    `toml:"request_timeout"`         // overall timeout for a single API request, 0 for none
+	MaxIdleConns        *int    `toml:"max_idle_conns"`          // limit on idle (keep-alive) connections, 0 for no limit
+	MaxIdleConnsPerHost *int    `toml:"max_idle_conns_per_host"` // limit on idle connections per endpoint
+	IdleConnTimeout     *int    `toml:"idle_conn_timeout"`       // how long an idle connection is kept, 0 for no limit
 }
 
 type influxDBConfig struct {
@@ -77,6 +143,16 @@ type prometheusConfig struct {
 	InstanceLabelName *string `toml:"instance_label_name"`
 }
 
+// routeConfig is a routing rule, sending the workloads it matches to its own
+// back ends instead of the stats_processor(s). Each setting that is given must
+// match; patterns are as for include_datasets.
+type routeConfig struct {
+	Clusters      []string `toml:"clusters"`       // cluster name or hostname patterns
+	Datasets      []string `toml:"datasets"`       // dataset name or id patterns
+	WorkloadTypes []string `toml:"workload_types"` // workload types, e.g. "System" or "Pinned"
+	Backends      []string `toml:"backends"`       // back ends, e.g. "influxdbv2" or "influxdbv2.<name>"
+}
+
 type promSdConf struct {
 	Enabled    bool
 	ListenAddr string `toml:"listen_addr"`
@@ -84,14 +160,185 @@ type promSdConf struct {
 }
 
 type clusterConf struct {
-	Hostname       string  // cluster name/ip; ideally use a SmartConnect name
-	Username       string  // account with the appropriate PAPI roles
-	Password       string  // password for the account
-	AuthType       string  // authentication type: "session" or "basic-auth"
-	SSLCheck       bool    `toml:"verify-ssl"` // turn on/off SSL cert checking to handle self-signed certificates
-	Disabled       bool    // if set, disable collection for this cluster
-	PrometheusPort *uint64 `toml:"prometheus_port"` // If using the Prometheus collector, define the listener port for the metrics handler
-	PreserveCase   *bool   `toml:"preserve_case"`   // Overwrite normalization of Cluster Name
+	Hostname        string                    // cluster name/ip; ideally use a SmartConnect name
+	FailoverHosts   []string                  `toml:"failover_hosts"` // additional node names/IPs (optionally host:port) to fail over to
+	Username        string                    // account with the appropriate PAPI roles
+	Password        string                    // password for the account
+	AuthType        string                    // authentication type: "session" or "basic-auth"
+	SSLCheck        bool                      `toml:"verify-ssl"` // turn on/off SSL cert checking to handle self-signed certificates
+	Disabled        bool                      // if set, disable collection for this cluster
+	PrometheusPort  *uint64                   `toml:"prometheus_port"`     // If using the Prometheus collector, define the listener port for the metrics handler
+	PreserveCase    *bool                     `toml:"preserve_case"`       // Overwrite normalization of Cluster Name
+	PerNode         *bool                     `toml:"per_node_collection"` // Override global per-node collection setting
+	PollInterval    *int                      `toml:"poll_interval"`       // Override global poll interval, in seconds
+	IncludeDatasets []string                  `toml:"include_datasets"`    // Override global include_datasets
+	ExcludeDatasets []string                  `toml:"exclude_datasets"`    // Override global exclude_datasets
+	DatasetParams   map[string]map[string]any `toml:"dataset_params"`      // extra workload query parameters, keyed by dataset name
+	apiConnConfig                             // overrides for the global API connection settings
+	clusterTLSConfig
+}
+
+// workloadParamKind is the kind of value a workload query parameter accepts
+type workloadParamKind int
+
+const (
+	paramBool   workloadParamKind = iota
+	paramInt                      // integer
+	paramString                   // single string
+	paramList                     // string, integer or array of either, sent comma-separated
+)
+
+// workloadParams lists the documented query parameters of the statistics
+// summary workload endpoint that may be set in dataset_params. "dataset" is
+// always set by the collector.
+var workloadParams = map[string]workloadParamKind{
+	"degraded":         paramBool,
+	"numeric":          paramBool,
+	"timeout":          paramInt,
+	"sort":             paramString,
+	"totalby":          paramList,
+	"nodes":            paramList,
+	"protocols":        paramList,
+	"usernames":        paramList,
+	"user_ids":         paramList,
+	"user_sids":        paramList,
+	"groupnames":       paramList,
+	"group_ids":        paramList,
+	"group_sids":       paramList,
+	"paths":            paramList,
+	"zone_names":       paramList,
+	"zone_ids":         paramList,
+	"share_names":      paramList,
+	"export_ids":       paramList,
+	"local_addresses":  paramList,
+	"remote_addresses": paramList,
+	"job_types":        paramList,
+	"system_names":     paramList,
+	"domain_ids":       paramList,
+	"local_names":      paramList,
+	"remote_names":     paramList,
+}
+
+// datasetQuery validates the dataset_params for one dataset and converts them
+// to query parameters
+func datasetQuery(params map[string]any) (url.Values, error) {
+	q := make(url.Values)
+	for name, v := range params {
+		kind, ok := workloadParams[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown workload parameter %q", name)
+		}
+		var s string
+		var valid bool
+		switch kind {
+		case paramBool:
+			var b bool
+			b, valid = v.(bool)
+			s = strconv.FormatBool(b)
+		case paramInt:
+			var i int64
+			i, valid = v.(int64)
+			s = strconv.FormatInt(i, 10)
+		case paramString:
+			s, valid = v.(string)
+		case paramList:
+			s, valid = paramListValue(v)
+		}
+		if !valid || s == "" {
+			return nil, fmt.Errorf("invalid value %v for workload parameter %q", v, name)
+		}
+		q.Set(name, s)
+	}
+	return q, nil
+}
+
+// paramListValue converts a string, integer or array of either to a
+// comma-separated list
+func paramListValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := paramListValue(item)
+			if !ok {
+				return "", false
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), true
+	}
+	return "", false
+}
+
+// clusterTLSConfig holds the optional TLS settings for talking to a cluster
+type clusterTLSConfig struct {
+	CAFile       string   `toml:"ca_file"`          // PEM CA bundle to verify the cluster certificate against
+	ClientCert   string   `toml:"client_cert"`      // PEM client certificate to present to the cluster
+	ClientKey    string   `toml:"client_key"`       // PEM private key for client_cert
+	ServerName   string   `toml:"server_name"`      // name to verify the cluster certificate against
+	Fingerprints []string `toml:"tls_fingerprints"` // pinned SHA-256 fingerprints of the cluster certificate(s)
+}
+
+// defaultAPIConnConfig returns the built-in API connection settings
+func defaultAPIConnConfig() apiConnConfig {
+	return apiConnConfig{
+		APIPort:             ptr(defaultAPIPort),
+		APIScheme:           ptr(defaultAPIScheme),
+		ConnectTimeout:      ptr(defaultConnectTimeout),
+		TLSHandshakeTimeout: ptr(defaultTLSHandshakeTimeout),
+		RequestTimeout:      ptr(defaultRequestTimeout),
+		MaxIdleConns:        ptr(defaultMaxIdleConns),
+		MaxIdleConnsPerHost: ptr(defaultMaxIdleConnsPerHost),
+		IdleConnTimeout:     ptr(defaultIdleConnTimeout),
+	}
+}
+
+// inherit sets *p to the default d if it is unset
+func inherit[T any](p **T, d *T) {
+	if *p == nil {
+		*p = d
+	}
+}
+
+// applyDefaults fills any unset API connection settings from the given defaults
+func (a *apiConnConfig) applyDefaults(d apiConnConfig) {
+	inherit(&a.APIPort, d.APIPort)
+	inherit(&a.APIScheme, d.APIScheme)
+	inherit(&a.ConnectTimeout, d.ConnectTimeout)
+	inherit(&a.TLSHandshakeTimeout, d.TLSHandshakeTimeout)
+	inherit(&a.RequestTimeout, d.RequestTimeout)
+	inherit(&a.MaxIdleConns, d.MaxIdleConns)
+	inherit(&a.MaxIdleConnsPerHost, d.MaxIdleConnsPerHost)
+	inherit(&a.IdleConnTimeout, d.IdleConnTimeout)
+}
+
+// validate checks that fully-populated API connection settings are sane
+func (a *apiConnConfig) validate() error {
+	if *a.APIPort <= 0 || *a.APIPort > 65535 {
+		return fmt.Errorf("invalid api_port %d", *a.APIPort)
+	}
+	scheme := strings.ToLower(*a.APIScheme)
+	if scheme != "https" && scheme != "http" {
+		return fmt.Errorf("invalid api_scheme %q, must be \"https\" or \"http\"", *a.APIScheme)
+	}
+	a.APIScheme = &scheme
+	for name, v := range map[string]int{
+		"connect_timeout":         *a.ConnectTimeout,
+		"tls_handshake_timeout":   *a.TLSHandshakeTimeout,
+		"request_timeout":         *a.RequestTimeout,
+		"max_idle_conns":          *a.MaxIdleConns,
+		"max_idle_conns_per_host": *a.MaxIdleConnsPerHost,
+		"idle_conn_timeout":       *a.IdleConnTimeout,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
 }
 
 // validateConfigVersion checks the version of the config file to ensure that it is
@@ -115,14 +362,27 @@ func validateConfigVersion(confVersion string) error {
 func readConfig(configFileName string) (tomlConfig, error) {
 	var conf tomlConfig
 	conf.Global.MaxRetries = defaultMaxRetries
+	conf.Global.RetryInitialIntvl = defaultRetryInitialIntvl
+	conf.Global.RetryMaxIntvl = defaultRetryMaxIntvl
 	conf.Global.ProcessorMaxRetries = processorDefaultMaxRetries
 	conf.Global.ProcessorRetryIntvl = processorDefaultRetryIntvl
 	conf.Global.MinUpdateInvtl = defaultMinUpdateInterval
+	conf.Global.PollInterval = defaultPollInterval
 	conf.Global.PreserveCase = defaultPreserveCase
+	conf.Global.LookupCacheTTL = defaultLookupCacheTTL
+	conf.Global.IdentityCacheSize = defaultIdentityCacheSize
+	conf.Global.IdentityCacheTTL = defaultIdentityCacheTTL
+	conf.Global.NodeConcurrency = defaultNodeConcurrency
+	conf.Global.DatasetConcurrency = defaultDatasetConcurrency
+	conf.Global.SpoolMaxSize = defaultSpoolMaxSize
+	conf.Global.SpoolMaxAge = defaultSpoolMaxAge
 	_, err := toml.DecodeFile(configFileName, &conf)
 	if err != nil {
 		return tomlConfig{}, fmt.Errorf("failed to read config file %s: %w", configFileName, err)
 	}
+	if err := decodeBackendInstances(configFileName, &conf); err != nil {
+		return tomlConfig{}, fmt.Errorf("failed to read config file %s: %w", configFileName, err)
+	}
 	if err := validateConfigVersion(conf.Global.Version); err != nil {
 		return tomlConfig{}, err
 	}
@@ -130,12 +390,198 @@ func readConfig(configFileName string) (tomlConfig, error) {
 	if conf.Global.MaxRetries <= 0 {
 		conf.Global.MaxRetries = math.MaxInt
 	}
+	if conf.Global.RetryInitialIntvl <= 0 {
+		return tomlConfig{}, fmt.Errorf("retry_initial_interval must be positive")
+	}
+	if conf.Global.RetryMaxIntvl < conf.Global.RetryInitialIntvl {
+		return tomlConfig{}, fmt.Errorf("retry_max_interval must not be less than retry_initial_interval")
+	}
+	if conf.Global.LookupCacheTTL <= 0 {
+		return tomlConfig{}, fmt.Errorf("lookup_cache_ttl must be positive")
+	}
+	if conf.Global.IdentityCacheSize <= 0 {
+		return tomlConfig{}, fmt.Errorf("identity_cache_size must be positive")
+	}
+	if conf.Global.IdentityCacheTTL <= 0 {
+		return tomlConfig{}, fmt.Errorf("identity_cache_ttl must be positive")
+	}
+	if conf.Global.NodeConcurrency <= 0 {
+		return tomlConfig{}, fmt.Errorf("node_concurrency must be positive")
+	}
+	if conf.Global.MinUpdateInvtl <= 0 {
+		return tomlConfig{}, fmt.Errorf("min_update_interval_override must be positive")
+	}
+	if conf.Global.PollInterval <= 0 {
+		return tomlConfig{}, fmt.Errorf("poll_interval must be positive")
+	}
+	if conf.Global.DatasetConcurrency <= 0 {
+		return tomlConfig{}, fmt.Errorf("dataset_concurrency must be positive")
+	}
+	if conf.Global.SpoolMaxSize <= 0 {
+		return tomlConfig{}, fmt.Errorf("spool_max_size must be positive")
+	}
+	if conf.Global.SpoolMaxAge <= 0 {
+		return tomlConfig{}, fmt.Errorf("spool_max_age must be positive")
+	}
 	if conf.Global.ProcessorMaxRetries <= 0 {
 		conf.Global.ProcessorMaxRetries = math.MaxInt
 	}
+	if conf.Global.Processor != "" && len(conf.Global.Processors) > 0 {
+		return tomlConfig{}, fmt.Errorf("only one of stats_processor and stats_processors may be set")
+	}
+	for i, name := range conf.Global.Processors {
+		if slices.Contains(conf.Global.Processors[:i], name) {
+			return tomlConfig{}, fmt.Errorf("stats_processors lists %q more than once", name)
+		}
+	}
+	for _, name := range conf.Global.processors() {
+		if err := conf.checkBackend(name); err != nil {
+			return tomlConfig{}, err
+		}
+	}
+	for i, rc := range conf.Routes {
+		if _, err := newRoute(rc); err != nil {
+			return tomlConfig{}, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		for _, name := range rc.Backends {
+			if err := conf.checkBackend(name); err != nil {
+				return tomlConfig{}, fmt.Errorf("route %d: %w", i+1, err)
+			}
+		}
+	}
+	conf.Global.apiConnConfig.applyDefaults(defaultAPIConnConfig())
+	if err := conf.Global.apiConnConfig.validate(); err != nil {
+		return tomlConfig{}, fmt.Errorf("global: %w", err)
+	}
+	if _, err := newDatasetFilter(conf.Global.IncludeDatasets, conf.Global.ExcludeDatasets); err != nil {
+		return tomlConfig{}, fmt.Errorf("global: %w", err)
+	}
+	for i := range conf.Clusters {
+		cc := &conf.Clusters[i]
+		cc.apiConnConfig.applyDefaults(conf.Global.apiConnConfig)
+		if err := cc.apiConnConfig.validate(); err != nil {
+			return tomlConfig{}, fmt.Errorf("cluster %s: %w", cc.Hostname, err)
+		}
+		for ds, params := range cc.DatasetParams {
+			if _, err := datasetQuery(params); err != nil {
+				return tomlConfig{}, fmt.Errorf("cluster %s: dataset_params.%s: %w", cc.Hostname, ds, err)
+			}
+		}
+		if _, err := newDatasetFilter(cc.IncludeDatasets, cc.ExcludeDatasets); err != nil {
+			return tomlConfig{}, fmt.Errorf("cluster %s: %w", cc.Hostname, err)
+		}
+	}
 	return conf, nil
 }
 
+// processors returns the names of the back ends to write to
+func (gc globalConfig) processors() []string {
+	if len(gc.Processors) > 0 {
+		return gc.Processors
+	}
+	return []string{gc.Processor}
+}
+
+// decodeBackendInstances reads the named instance sections of the back ends
+// that support them, e.g. [influxdbv2.team_a], into conf
+func decodeBackendInstances(configFileName string, conf *tomlConfig) error {
+	var sections struct {
+		InfluxDB   map[string]toml.Primitive `toml:"influxdb"`
+		InfluxDBv2 map[string]toml.Primitive `toml:"influxdbv2"`
+	}
+	md, err := toml.DecodeFile(configFileName, &sections)
+	if err != nil {
+		return err
+	}
+	if conf.InfluxDBInstances, err = decodeInstances[influxDBConfig](md, influxPluginName, sections.InfluxDB); err != nil {
+		return err
+	}
+	conf.InfluxDBv2Instances, err = decodeInstances[influxDBv2Config](md, influxV2PluginName, sections.InfluxDBv2)
+	return err
+}
+
+// decodeInstances decodes the subtables of a back end section
+func decodeInstances[T any](md toml.MetaData, section string, keys map[string]toml.Primitive) (map[string]T, error) {
+	instances := make(map[string]T)
+	for name, prim := range keys {
+		if md.Type(section, name) != "Hash" {
+			continue // a setting of the unnamed instance
+		}
+		if !validInstanceName(name) {
+			return nil, fmt.Errorf("invalid back end instance name [%s.%s]", section, name)
+		}
+		var ic T
+		if err := md.PrimitiveDecode(prim, &ic); err != nil {
+			return nil, fmt.Errorf("[%s.%s]: %w", section, name, err)
+		}
+		instances[name] = ic
+	}
+	return instances, nil
+}
+
+// validInstanceName reports whether name may be used as a back end instance
+// name; it is also used in the spool directory name
+func validInstanceName(name string) bool {
+	return name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") == ""
+}
+
+// checkBackend checks that a back end, given as a plugin name, optionally
+// followed by "." and the name of one of its instances, is configured
+func (conf *tomlConfig) checkBackend(name string) error {
+	if name == "" {
+		return fmt.Errorf("no stats_processor set")
+	}
+	plugin, instance, named := strings.Cut(name, ".")
+	var ok bool
+	switch plugin {
+	case influxPluginName:
+		_, ok = conf.InfluxDBInstances[instance]
+	case influxV2PluginName:
+		_, ok = conf.InfluxDBv2Instances[instance]
+	case discardPluginName, promPluginName:
+		if named {
+			return fmt.Errorf("back end %q: %s does not support named instances", name, plugin)
+		}
+	default:
+		return fmt.Errorf("unsupported backend plugin %q", name)
+	}
+	if named && !ok {
+		return fmt.Errorf("back end %q has no [%s] section", name, name)
+	}
+	return nil
+}
+
+// backends returns the names of every back end that may be written to
+func (conf *tomlConfig) backends() []string {
+	names := slices.Clone(conf.Global.processors())
+	for _, rc := range conf.Routes {
+		for _, name := range rc.Backends {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// influxDBInstance returns the settings of an InfluxDB instance; the unnamed
+// instance is the [influxdb] section
+func (conf *tomlConfig) influxDBInstance(instance string) influxDBConfig {
+	if instance == "" {
+		return conf.InfluxDB
+	}
+	return conf.InfluxDBInstances[instance]
+}
+
+// influxDBv2Instance returns the settings of an InfluxDBv2 instance; the
+// unnamed instance is the [influxdbv2] section
+func (conf *tomlConfig) influxDBv2Instance(instance string) influxDBv2Config {
+	if instance == "" {
+		return conf.InfluxDBv2
+	}
+	return conf.InfluxDBv2Instances[instance]
+}
+
 // mustReadConfig reads the config file or exits the program if this fails.
 // Used at startup where a bad config is unrecoverable.
 func mustReadConfig(configFileName string) tomlConfig {
@@ -147,6 +593,11 @@ func mustReadConfig(configFileName string) tomlConfig {
 	return conf
 }
 
+// ptr returns a pointer to a copy of v
+func ptr[T any](v T) *T {
+	return &v
+}
+
 const envPrefix = "$env:"
 
 func secretFromEnv(s string) (string, error) {
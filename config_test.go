@@ -2,7 +2,10 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestSecretFromEnv(t *testing.T) {
@@ -77,3 +80,368 @@ func TestValidateConfigVersion_Invalid(t *testing.T) {
 		})
 	}
 }
+
+// writeTestConfig writes the given config file contents to a temporary file
+// and returns its path
+func writeTestConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "goppstats.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("unable to write test config: %v", err)
+	}
+	return path
+}
+
+func TestReadConfigAPIConnSettings(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+request_timeout = 60
+connect_timeout = 5
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+
+[[cluster]]
+hostname = "c2.example.com"
+username = "u"
+password = "p"
+api_port = 443
+api_scheme = "HTTPS"
+request_timeout = 0
+max_idle_conns_per_host = 8
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	c1 := conf.Clusters[0].apiConnConfig
+	if *c1.APIPort != defaultAPIPort || *c1.APIScheme != "https" {
+		t.Errorf("cluster 1 port/scheme = %d/%s, want defaults", *c1.APIPort, *c1.APIScheme)
+	}
+	if *c1.RequestTimeout != 60 || *c1.ConnectTimeout != 5 {
+		t.Errorf("cluster 1 timeouts = %d/%d, want global values 60/5", *c1.RequestTimeout, *c1.ConnectTimeout)
+	}
+	if *c1.TLSHandshakeTimeout != defaultTLSHandshakeTimeout {
+		t.Errorf("cluster 1 TLS handshake timeout = %d, want default", *c1.TLSHandshakeTimeout)
+	}
+	c2 := conf.Clusters[1].apiConnConfig
+	if *c2.APIPort != 443 || *c2.APIScheme != "https" {
+		t.Errorf("cluster 2 port/scheme = %d/%s, want 443/https", *c2.APIPort, *c2.APIScheme)
+	}
+	if *c2.RequestTimeout != 0 || *c2.MaxIdleConnsPerHost != 8 {
+		t.Errorf("cluster 2 overrides not applied: request_timeout=%d max_idle_conns_per_host=%d",
+			*c2.RequestTimeout, *c2.MaxIdleConnsPerHost)
+	}
+}
+
+func TestReadConfigAPIConnSettingsInvalid(t *testing.T) {
+	for name, setting := range map[string]string{
+		"scheme":  `api_scheme = "ftp"`,
+		"port":    `api_port = 70000`,
+		"timeout": `connect_timeout = -1`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+`+setting+"\n")
+			if _, err := readConfig(path); err == nil {
+				t.Errorf("expected error for invalid setting %s", setting)
+			}
+		})
+	}
+}
+
+func TestReadConfigRetryIntervals(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+retry_initial_interval = 2
+retry_max_interval = 60
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if conf.Global.RetryInitialIntvl != 2 || conf.Global.RetryMaxIntvl != 60 {
+		t.Errorf("got retry intervals %d/%d, want 2/60", conf.Global.RetryInitialIntvl, conf.Global.RetryMaxIntvl)
+	}
+
+	for _, setting := range []string{
+		"retry_initial_interval = 0",
+		"retry_initial_interval = 10\nretry_max_interval = 5",
+		"node_concurrency = 0",
+		"dataset_concurrency = 0",
+		"spool_max_size = 0",
+		"spool_max_age = -1",
+		"lookup_cache_ttl = 0",
+	} {
+		path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+`+setting+"\n")
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("expected error for invalid setting %q", setting)
+		}
+	}
+}
+
+func TestReadConfigDatasetParams(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+[cluster.dataset_params.nfs_users]
+totalby = "zone_name"
+protocols = ["nfs3", "nfs4"]
+nodes = [1, 2]
+numeric = true
+timeout = 30
+domain_ids = ["d1"]
+local_names = "l1"
+remote_names = ["r1", "r2"]
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	c, err := newCluster(conf.Clusters[0], conf.Global)
+	if err != nil {
+		t.Fatalf("newCluster failed: %v", err)
+	}
+	want := "domain_ids=d1&local_names=l1&nodes=1%2C2&numeric=true&protocols=nfs3%2Cnfs4" +
+		"&remote_names=r1%2Cr2&timeout=30&totalby=zone_name"
+	if got := c.datasetParams["nfs_users"].Encode(); got != want {
+		t.Errorf("nfs_users params = %s, want %s", got, want)
+	}
+}
+
+func TestReadConfigPollInterval(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+poll_interval = 60
+min_update_interval_override = 20
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+
+[[cluster]]
+hostname = "c2.example.com"
+username = "u"
+password = "p"
+poll_interval = 20
+
+[[cluster]]
+hostname = "c3.example.com"
+username = "u"
+password = "p"
+poll_interval = 5
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	for i, want := range []time.Duration{60 * time.Second, 20 * time.Second, 20 * time.Second} {
+		c, err := newCluster(conf.Clusters[i], conf.Global)
+		if err != nil {
+			t.Fatalf("newCluster failed: %v", err)
+		}
+		if c.pollInterval != want {
+			t.Errorf("cluster %s poll interval = %v, want %v", c.Hostname, c.pollInterval, want)
+		}
+	}
+
+	for _, setting := range []string{"poll_interval = 0", "min_update_interval_override = 0"} {
+		path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+`+setting+"\n")
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("expected error for invalid setting %q", setting)
+		}
+	}
+}
+
+func TestReadConfigProcessors(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processors = ["influxdb", "influxdbv2", "prometheus"]
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if got := conf.Global.processors(); len(got) != 3 || got[2] != promPluginName {
+		t.Errorf("processors = %v, want influxdb, influxdbv2 and prometheus", got)
+	}
+
+	for _, setting := range []string{
+		"stats_processor = \"discard\"\nstats_processors = [\"prometheus\"]",
+		"stats_processors = [\"discard\", \"discard\"]",
+	} {
+		path := writeTestConfig(t, `
+[global]
+version = "0.32"
+`+setting+"\n")
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("expected error for invalid setting %q", setting)
+		}
+	}
+}
+
+func TestReadConfigRoutes(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "influxdbv2"
+
+[influxdbv2]
+host = "influx.example.com"
+bucket = "isilon"
+
+[influxdbv2.team_a]
+host = "influx-a.example.com"
+bucket = "team_a"
+
+[[route]]
+datasets = ["team_a_*"]
+backends = ["influxdbv2.team_a"]
+
+[[route]]
+clusters = ["lab*"]
+workload_types = ["System", "Regular"]
+backends = ["influxdbv2", "prometheus"]
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if conf.InfluxDBv2.Bucket != "isilon" || conf.influxDBv2Instance("").Host != "influx.example.com" {
+		t.Errorf("unnamed instance = %+v", conf.InfluxDBv2)
+	}
+	if ic := conf.influxDBv2Instance("team_a"); ic.Bucket != "team_a" || ic.Host != "influx-a.example.com" {
+		t.Errorf("team_a instance = %+v", ic)
+	}
+	if len(conf.InfluxDBv2Instances) != 1 || len(conf.InfluxDBInstances) != 0 {
+		t.Errorf("got %d InfluxDBv2 and %d InfluxDB instances, want 1 and 0",
+			len(conf.InfluxDBv2Instances), len(conf.InfluxDBInstances))
+	}
+	if len(conf.Routes) != 2 || conf.Routes[1].WorkloadTypes[0] != wSystem {
+		t.Errorf("routes = %+v", conf.Routes)
+	}
+	want := []string{influxV2PluginName, "influxdbv2.team_a", promPluginName}
+	if got := conf.backends(); !slices.Equal(got, want) {
+		t.Errorf("backends = %v, want %v", got, want)
+	}
+
+	for _, setting := range []string{
+		"stats_processor = \"influxdbv2.missing\"",
+		"stats_processor = \"prometheus.team_a\"",
+		"stats_processor = \"discard\"\n[[route]]\nbackends = [\"influxdb.team_a\"]",
+		"stats_processor = \"discard\"\n[[route]]\ndatasets = [\"nfs_*\"]",
+		"stats_processor = \"discard\"\n[[route]]\nworkload_types = [\"Bogus\"]\nbackends = [\"discard\"]",
+		"stats_processor = \"discard\"\n[[route]]\nclusters = [\"/(/\"]\nbackends = [\"discard\"]",
+		"stats_processor = \"discard\"\n[influxdb.\"a/b\"]\nhost = \"x\"",
+	} {
+		path := writeTestConfig(t, `
+[global]
+version = "0.32"
+`+setting+"\n")
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("expected error for invalid setting %q", setting)
+		}
+	}
+}
+
+func TestReadConfigDatasetSelection(t *testing.T) {
+	path := writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+exclude_datasets = ["System"]
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+
+[[cluster]]
+hostname = "c2.example.com"
+username = "u"
+password = "p"
+exclude_datasets = []
+include_datasets = ["/^nfs_/"]
+`)
+	conf, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	system := DsInfoEntry{ID: 0, Name: "System"}
+	nfs := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	for i, want := range [][2]bool{{false, true}, {false, true}} {
+		c, err := newCluster(conf.Clusters[i], conf.Global)
+		if err != nil {
+			t.Fatalf("newCluster failed: %v", err)
+		}
+		if got := [2]bool{c.datasets.selected(system), c.datasets.selected(nfs)}; got != want {
+			t.Errorf("cluster %s selects System/nfs_users = %v, want %v", c.Hostname, got, want)
+		}
+	}
+
+	path = writeTestConfig(t, `
+[global]
+version = "0.32"
+stats_processor = "discard"
+
+[[cluster]]
+hostname = "c1.example.com"
+username = "u"
+password = "p"
+include_datasets = ["/[/"]
+`)
+	if _, err := readConfig(path); err == nil {
+		t.Error("expected error for invalid include_datasets pattern")
+	}
+}
+
+func TestDatasetQueryInvalid(t *testing.T) {
+	for name, params := range map[string]map[string]any{
+		"unknown parameter": {"colour": "blue"},
+		"workload_ids":      {"workload_ids": []any{int64(1)}},
+		"dataset":           {"dataset": "other"},
+		"bool type":         {"numeric": "yes"},
+		"int type":          {"timeout": "30"},
+		"string type":       {"sort": []any{"ops"}},
+		"list item type":    {"protocols": []any{"nfs3", true}},
+		"empty string":      {"usernames": ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := datasetQuery(params); err == nil {
+				t.Errorf("expected error for %v", params)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// namePattern matches a name, such as a dataset or cluster name. Patterns are
+// shell-style globs (e.g. "nfs_*" or "0"), or regular expressions if enclosed
+// in slashes (e.g. "/^(nfs|smb)_/").
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func newNamePattern(s string) (namePattern, error) {
+	if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return namePattern{}, fmt.Errorf("invalid regular expression %q: %w", s, err)
+		}
+		return namePattern{re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return namePattern{}, fmt.Errorf("invalid pattern %q: %w", s, err)
+	}
+	return namePattern{glob: s}, nil
+}
+
+// compileNamePatterns compiles the patterns of a setting
+func compileNamePatterns(setting string, patterns []string) ([]namePattern, error) {
+	var compiled []namePattern
+	for _, s := range patterns {
+		p, err := newNamePattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", setting, err)
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// match reports whether the pattern matches any of the names
+func (p namePattern) match(names ...string) bool {
+	for _, s := range names {
+		if p.re != nil {
+			if p.re.MatchString(s) {
+				return true
+			}
+		} else if ok, _ := path.Match(p.glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of the patterns matches any of the names
+func matchAny(patterns []namePattern, names ...string) bool {
+	for _, p := range patterns {
+		if p.match(names...) {
+			return true
+		}
+	}
+	return false
+}
+
+// datasetFilter selects the datasets to collect. If any include patterns are
+// given, only datasets matching one of them are collected; datasets matching
+// an exclude pattern are never collected. A nil filter selects every dataset.
+type datasetFilter struct {
+	include []namePattern
+	exclude []namePattern
+}
+
+// newDatasetFilter returns a filter for the given include and exclude
+// patterns, or nil if there are none
+func newDatasetFilter(include []string, exclude []string) (*datasetFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	var f datasetFilter
+	var err error
+	if f.include, err = compileNamePatterns("include_datasets", include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileNamePatterns("exclude_datasets", exclude); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// selected reports whether the dataset should be collected
+func (f *datasetFilter) selected(ds DsInfoEntry) bool {
+	if f == nil {
+		return true
+	}
+	names := []string{ds.Name, strconv.Itoa(ds.ID)}
+	if len(f.include) > 0 && !matchAny(f.include, names...) {
+		return false
+	}
+	return !matchAny(f.exclude, names...)
+}
+
+// apply returns the dataset info with only the selected datasets, and the
+// names of the datasets that were dropped
+func (f *datasetFilter) apply(di *DsInfo) (*DsInfo, []string) {
+	if f == nil {
+		return di, nil
+	}
+	filtered := &DsInfo{Resume: di.Resume}
+	var dropped []string
+	for _, ds := range di.Datasets {
+		if f.selected(ds) {
+			filtered.Datasets = append(filtered.Datasets, ds)
+		} else {
+			dropped = append(dropped, ds.Name)
+		}
+	}
+	filtered.Total = len(filtered.Datasets)
+	return filtered, dropped
+}
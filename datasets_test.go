@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDatasetFilter(t *testing.T) {
+	datasets := []DsInfoEntry{
+		{ID: 0, Name: "System"},
+		{ID: 1, Name: "nfs_users"},
+		{ID: 2, Name: "smb_users"},
+		{ID: 3, Name: "nfs_exports"},
+	}
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{"no filter", nil, nil, []string{"System", "nfs_users", "smb_users", "nfs_exports"}},
+		{"exclude by name", nil, []string{"System"}, []string{"nfs_users", "smb_users", "nfs_exports"}},
+		{"exclude by id", nil, []string{"0"}, []string{"nfs_users", "smb_users", "nfs_exports"}},
+		{"include glob", []string{"nfs_*"}, nil, []string{"nfs_users", "nfs_exports"}},
+		{"include regexp", []string{"/_users$/"}, nil, []string{"nfs_users", "smb_users"}},
+		{"include and exclude", []string{"nfs_*", "2"}, []string{"/exports/"}, []string{"nfs_users", "smb_users"}},
+		{"nothing matches", []string{"none"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newDatasetFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("newDatasetFilter failed: %v", err)
+			}
+			di, dropped := f.apply(&DsInfo{Datasets: datasets, Total: len(datasets)})
+			var got []string
+			for _, ds := range di.Datasets {
+				got = append(got, ds.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %v, want %v", got, tt.want)
+			}
+			if di.Total != len(tt.want) || len(dropped) != len(datasets)-len(tt.want) {
+				t.Errorf("total = %d with %d dropped, want %d", di.Total, len(dropped), len(tt.want))
+			}
+		})
+	}
+
+	for _, pattern := range []string{"[", "/(/"} {
+		if _, err := newDatasetFilter(nil, []string{pattern}); err == nil {
+			t.Errorf("expected error for invalid pattern %q", pattern)
+		}
+	}
+}
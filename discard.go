@@ -28,3 +28,8 @@ func (s *DiscardSink) WritePPStats(_ context.Context, ds DsInfoEntry, stats []PP
 	// consider debug/trace statement here for stat count
 	return nil
 }
+
+// WriteClusterStats takes an array of ClusterStats and discards them.
+func (s *DiscardSink) WriteClusterStats(_ context.Context, stats []ClusterStat) error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const zonesPath = "/platform/1/zones"
+
+// AccessZone contains the fields of an access zone definition that we use
+type AccessZone struct {
+	ZoneID int    `json:"zone_id"`
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+}
+
+// GetZones returns every access zone defined on the cluster
+func (c *Cluster) GetZones(ctx context.Context) ([]AccessZone, error) {
+	return listAll[AccessZone](ctx, c, zonesPath, "zones")
+}
+
+// zoneCache is a per-cluster cache of the access zones, keyed by zone id
+type zoneCache = lookupCache[int, AccessZone]
+
+func newZoneCache(ttl time.Duration) *zoneCache {
+	return newLookupCache("access zones", ttl, loadZones)
+}
+
+// loadZones lists the access zones
+func loadZones(ctx context.Context, c *Cluster) (map[int]AccessZone, error) {
+	zones, err := c.GetZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]AccessZone, len(zones))
+	for _, zone := range zones {
+		byID[zone.ZoneID] = zone
+	}
+	return byID, nil
+}
+
+// zonesForLookup returns the access zones to search for protocol objects such
+// as exports and shares. If the zones cannot be listed (e.g. the API user
+// lacks the privilege), only the System zone is returned.
+func (c *Cluster) zonesForLookup(ctx context.Context) []AccessZone {
+	zones, err := c.GetZones(ctx)
+	if err != nil {
+		log.Warn("unable to list access zones, only looking in the System zone",
+			slog.String("cluster", c.name()), slog.Any("error", err))
+		return []AccessZone{{ZoneID: 1, Name: "System"}}
+	}
+	return zones
+}
+
+// NFSExport contains the fields of an NFS export definition that we use
+type NFSExport struct {
+	ID    int      `json:"id"`
+	Paths []string `json:"paths"`
+	Zone  string   `json:"zone"`
+}
+
+// GetExports returns every NFS export in the given access zone, or in the
+// default zone if zone is empty
+func (c *Cluster) GetExports(ctx context.Context, zone string) ([]NFSExport, error) {
+	path := exportPath
+	if zone != "" {
+		path += "?zone=" + url.QueryEscape(zone)
+	}
+	return listAll[NFSExport](ctx, c, path, "exports")
+}
+
+// exportCache is a per-cluster cache of the NFS exports in every access zone,
+// keyed by export id
+type exportCache = lookupCache[int, NFSExport]
+
+func newExportCache(ttl time.Duration) *exportCache {
+	return newLookupCache("NFS exports", ttl, loadExports)
+}
+
+// loadExports lists the NFS exports in every access zone
+func loadExports(ctx context.Context, c *Cluster) (map[int]NFSExport, error) {
+	byID := make(map[int]NFSExport)
+	for _, zone := range c.zonesForLookup(ctx) {
+		exports, err := c.GetExports(ctx, zone.Name)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", zone.Name, err)
+		}
+		for _, export := range exports {
+			if export.Zone == "" {
+				export.Zone = zone.Name
+			}
+			byID[export.ID] = export
+		}
+	}
+	return byID, nil
+}
+
+// exportPathTag returns the value of the export_path tag for an export: all
+// of its paths, comma-separated
+func exportPathTag(export NFSExport) string {
+	return strings.Join(export.Paths, ",")
+}
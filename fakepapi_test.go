@@ -0,0 +1,489 @@
+package main
+
+// In-process fake of the subset of the OneFS platform API (PAPI) used by the
+// collector, for end-to-end tests of the Cluster client and collection loop.
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeFixtureDir = "testdata/fakepapi"
+
+const (
+	fakeUsername = "statsuser"
+	fakePassword = "sekr1t"
+)
+
+// fakeFault describes an injected failure. A fault applies to requests
+// matching Method, Path and every parameter in Query (empty values match
+// anything) and is consumed once per matching request until Count reaches
+// zero. A negative Count makes the fault permanent.
+type fakeFault struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Count  int
+	// Status and Body are returned in place of the normal response
+	Status int
+	Body   string
+	Header http.Header
+	// Drop closes the connection without writing a response
+	Drop bool
+	// Delay stalls the request before the fault (or normal response) is served
+	Delay time.Duration
+}
+
+// fakeSession is a single authenticated PAPI session
+type fakeSession struct {
+	csrf    string
+	expires time.Time
+}
+
+// fakePAPI is a scriptable fake OneFS PAPI server
+type fakePAPI struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu sync.Mutex
+	// SessionTimeout is the timeout_absolute value returned on login, in seconds
+	SessionTimeout int
+	sessions       map[string]fakeSession
+	nextSession    int
+	responses      map[string][]byte // keyed by request path
+	workloads      map[string][]byte // keyed by dataset name
+	faults         []*fakeFault
+	hits           map[string]int         // keyed by "METHOD path"
+	queries        map[string]url.Values  // most recent query, keyed by path
+	headers        map[string]http.Header // most recent request headers, keyed by path
+	gzipped        int                    // number of gzip-encoded responses
+}
+
+// newFakePAPI starts a TLS fake PAPI server populated from the default
+// fixture files. The server is shut down when the test completes.
+func newFakePAPI(t *testing.T) *fakePAPI {
+	t.Helper()
+	f := &fakePAPI{
+		t:              t,
+		SessionTimeout: 14400,
+		sessions:       make(map[string]fakeSession),
+		responses:      make(map[string][]byte),
+		workloads:      make(map[string][]byte),
+		hits:           make(map[string]int),
+		queries:        make(map[string]url.Values),
+		headers:        make(map[string]http.Header),
+	}
+	f.loadFixture(configPath, "cluster_config.json")
+	f.loadFixture(platformLatestPath, "platform_latest.json")
+	f.loadFixture(perfSettingsPath, "performance_settings.json")
+	f.loadFixture(dsPath, "datasets.json")
+	f.loadFixture(zonesPath, "zones.json")
+	f.loadFixture(exportPath, "nfs_exports.json")
+	f.loadFixture(exportPath+"?zone=Tenant", "nfs_exports_tenant.json")
+	f.loadFixture(exportPath+"?resume=nfs-exports-2", "nfs_exports_2.json")
+	f.loadFixture(smbSharePath, "smb_shares.json")
+	f.loadFixture(smbSharePath+"?zone=Tenant", "smb_shares_tenant.json")
+	f.loadWorkloadFixture("System", "workload_System.json")
+	f.loadWorkloadFixture("nfs_users", "workload_nfs_users.json")
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// readFixture returns the contents of the named fixture file
+func (f *fakePAPI) readFixture(name string) []byte {
+	f.t.Helper()
+	b, err := os.ReadFile(filepath.Join(fakeFixtureDir, name))
+	if err != nil {
+		f.t.Fatalf("unable to read fixture %s: %v", name, err)
+	}
+	return b
+}
+
+// loadFixture serves the named fixture file in response to GET requests for path
+func (f *fakePAPI) loadFixture(path string, name string) {
+	f.setRaw(path, f.readFixture(name))
+}
+
+// loadWorkloadFixture serves the named fixture file as the workload summary for dataset
+func (f *fakePAPI) loadWorkloadFixture(dataset string, name string) {
+	b := f.readFixture(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.workloads[dataset] = b
+}
+
+// setRaw serves body in response to GET requests for path. A path with a
+// query string, e.g. "?resume=<token>", serves only requests with that query.
+func (f *fakePAPI) setRaw(path string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses[path] = body
+}
+
+// setJSON serves the JSON encoding of v in response to GET requests for path
+func (f *fakePAPI) setJSON(path string, v any) {
+	f.t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		f.t.Fatalf("unable to marshal response for %s: %v", path, err)
+	}
+	f.setRaw(path, b)
+}
+
+// setWorkload serves the JSON encoding of v as the workload summary for dataset
+func (f *fakePAPI) setWorkload(dataset string, v any) {
+	f.t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		f.t.Fatalf("unable to marshal workload for %s: %v", dataset, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.workloads[dataset] = b
+}
+
+// inject adds a fault to the server
+func (f *fakePAPI) inject(fault fakeFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// clearFaults removes every injected fault
+func (f *fakePAPI) clearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// expireSessions invalidates every session so the next request gets a 401
+func (f *fakePAPI) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions = make(map[string]fakeSession)
+}
+
+// hitCount returns the number of requests seen for the given method and path
+func (f *fakePAPI) hitCount(method string, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[method+" "+path]
+}
+
+// lastQuery returns the query parameters of the most recent request for path
+func (f *fakePAPI) lastQuery(path string) url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[path]
+}
+
+// lastHeader returns the headers of the most recent request for path
+func (f *fakePAPI) lastHeader(path string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers[path]
+}
+
+// gzipCount returns the number of responses sent gzip-encoded
+func (f *fakePAPI) gzipCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gzipped
+}
+
+// sessionCount returns the number of active sessions
+func (f *fakePAPI) sessionCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sessions)
+}
+
+// hostPort returns the host and port the fake server is listening on
+func (f *fakePAPI) hostPort() (string, int) {
+	f.t.Helper()
+	host, port, err := net.SplitHostPort(f.srv.Listener.Addr().String())
+	if err != nil {
+		f.t.Fatalf("unable to parse fake server address: %v", err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		f.t.Fatalf("unable to parse fake server port: %v", err)
+	}
+	return host, p
+}
+
+// cluster returns an unconnected Cluster pointing at the fake server
+func (f *fakePAPI) cluster(authType string) *Cluster {
+	host, port := f.hostPort()
+	return &Cluster{
+		AuthInfo: AuthInfo{
+			Username: fakeUsername,
+			Password: fakePassword,
+		},
+		AuthType:  authType,
+		Hostname:  host,
+		Port:      port,
+		VerifySSL: false,
+		retry: retryPolicy{
+			maxRetries:   2,
+			initialDelay: 10 * time.Millisecond,
+			maxDelay:     100 * time.Millisecond,
+		},
+	}
+}
+
+// writeError writes a PAPI errors envelope with the given status
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// takeFault returns the first fault matching the request, consuming one use of it
+func (f *fakePAPI) takeFault(r *http.Request) *fakeFault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, fault := range f.faults {
+		if fault.Method != "" && fault.Method != r.Method {
+			continue
+		}
+		if fault.Path != "" && fault.Path != r.URL.Path {
+			continue
+		}
+		if !queryMatches(r.URL.Query(), fault.Query) {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+// queryMatches reports whether query has every parameter in want
+func queryMatches(query url.Values, want url.Values) bool {
+	for k, v := range want {
+		if !slices.Equal(query[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakePAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.hits[r.Method+" "+r.URL.Path]++
+	f.queries[r.URL.Path] = r.URL.Query()
+	f.headers[r.URL.Path] = r.Header.Clone()
+	f.mu.Unlock()
+
+	if fault := f.takeFault(r); fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.Drop {
+			if hj, ok := w.(http.Hijacker); ok {
+				conn, _, err := hj.Hijack()
+				if err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if fault.Status != 0 {
+			for k, v := range fault.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(fault.Status)
+			_, _ = w.Write([]byte(fault.Body))
+			return
+		}
+	}
+
+	if r.URL.Path == sessionPath {
+		f.serveSession(w, r)
+		return
+	}
+	if !f.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "Authorization required")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", "Method not allowed")
+		return
+	}
+
+	f.mu.Lock()
+	var body []byte
+	var found bool
+	if r.URL.Path == ppWorkloadPath {
+		dataset := r.URL.Query().Get("dataset")
+		if dataset == "" {
+			dataset = "System"
+		}
+		body, found = f.workloads[dataset]
+		if found {
+			body = filterWorkloadNodes(body, r.URL.Query().Get("nodes"))
+		}
+	} else {
+		// a response registered for the exact query takes precedence
+		body, found = f.responses[r.URL.Path+"?"+r.URL.RawQuery]
+		if !found && r.URL.Query().Get("resume") == "" {
+			body, found = f.responses[r.URL.Path]
+		}
+	}
+	f.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("Path %s not found", r.URL.Path))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		f.mu.Lock()
+		f.gzipped++
+		f.mu.Unlock()
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+		return
+	}
+	_, _ = w.Write(body)
+}
+
+// filterWorkloadNodes returns only the workload entries for the given nodes,
+// a comma-separated list of node numbers, or all entries for "all" or none
+func filterWorkloadNodes(body []byte, nodes string) []byte {
+	if nodes == "" || nodes == "all" {
+		return body
+	}
+	want := make(map[float64]bool)
+	for _, n := range strings.Split(nodes, ",") {
+		lnn, err := strconv.Atoi(n)
+		if err != nil {
+			return body
+		}
+		want[float64(lnn)] = true
+	}
+	var resp struct {
+		Workload []map[string]any `json:"workload"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return body
+	}
+	filtered := resp.Workload[:0]
+	for _, w := range resp.Workload {
+		if node, _ := w["node"].(float64); want[node] {
+			filtered = append(filtered, w)
+		}
+	}
+	resp.Workload = filtered
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+// serveSession handles the session login endpoint
+func (f *fakePAPI) serveSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		f.deleteSession(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", "Method not allowed")
+		return
+	}
+	var creds struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Services []string `json:"services"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "Unable to parse request body")
+		return
+	}
+	if creds.Username != fakeUsername || creds.Password != fakePassword {
+		writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "Invalid username or password")
+		return
+	}
+	f.mu.Lock()
+	f.nextSession++
+	id := fmt.Sprintf("session-%d", f.nextSession)
+	csrf := fmt.Sprintf("csrf-%d", f.nextSession)
+	timeout := f.SessionTimeout
+	f.sessions[id] = fakeSession{csrf: csrf, expires: time.Now().Add(time.Duration(timeout) * time.Second)}
+	f.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: "isisessid", Value: id, Path: "/", HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: "isicsrf", Value: csrf, Path: "/", Secure: true})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"services":         creds.Services,
+		"timeout_absolute": timeout,
+		"timeout_inactive": 900,
+		"username":         creds.Username,
+	})
+}
+
+// deleteSession handles logging out of a session
+func (f *fakePAPI) deleteSession(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "Authorization required")
+		return
+	}
+	cookie, err := r.Cookie("isisessid")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "No session")
+		return
+	}
+	f.mu.Lock()
+	delete(f.sessions, cookie.Value)
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized checks the request carries valid basic auth or session credentials
+func (f *fakePAPI) authorized(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok {
+		return username == fakeUsername && password == fakePassword
+	}
+	cookie, err := r.Cookie("isisessid")
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	session, ok := f.sessions[cookie.Value]
+	if !ok || time.Now().After(session.expires) {
+		return false
+	}
+	return strings.EqualFold(r.Header.Get("X-CSRF-Token"), session.csrf)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Limits for a back end that fails while others are accepting writes
+const (
+	fanoutMaxRetryIntvl = 60 * time.Second // longest delay between retries
+	fanoutMaxQueued     = 100              // most batches queued for retry
+)
+
+// fanoutJob is a write queued for retry on one back end
+type fanoutJob struct {
+	fn       func(context.Context, DBWriter) error
+	attempts int
+}
+
+// fanoutTarget is one of the back ends of a fanoutWriter
+type fanoutTarget struct {
+	name string
+	w    DBWriter
+
+	mu       sync.Mutex
+	failures int         // consecutive failed writes
+	queue    []fanoutJob // writes waiting to be retried, oldest first
+	draining bool        // whether a goroutine is retrying the queue
+}
+
+// down reports whether the back end's last write failed or writes to it are
+// still queued for retry
+func (t *fanoutTarget) down() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures > 0 || len(t.queue) > 0
+}
+
+// fanoutWriter is a DBWriter that sends everything to several back ends
+// concurrently. A write that fails on some back ends but succeeds on another
+// is queued for each back end that failed and retried there in the
+// background, in order, up to stats_processor_max_retries times with a delay
+// of stats_processor_retry_interval seconds doubling up to a minute. While a
+// back end has writes queued, new ones are queued behind them, so a failing
+// back end never holds up or duplicates writes to the others. Writes only
+// fail if no back end accepts them; nothing is queued then, and the caller
+// may retry them.
+type fanoutWriter struct {
+	targets []*fanoutTarget
+	gc      globalConfig
+
+	mu  sync.Mutex
+	ctx context.Context // bounds the background retries
+}
+
+// newFanoutWriter returns a DBWriter that writes to each of the named back ends
+func newFanoutWriter(names []string, writers []DBWriter, gc globalConfig) *fanoutWriter {
+	f := &fanoutWriter{gc: gc}
+	for i, w := range writers {
+		f.targets = append(f.targets, &fanoutTarget{name: names[i], w: w})
+	}
+	return f
+}
+
+// Init initializes each of the back ends
+func (f *fanoutWriter) Init(ctx context.Context, cluster *Cluster, config *tomlConfig, ci int) error {
+	f.mu.Lock()
+	if f.ctx == nil {
+		f.ctx = ctx
+	}
+	f.mu.Unlock()
+	for _, t := range f.targets {
+		if err := t.w.Init(ctx, cluster, config, ci); err != nil {
+			return fmt.Errorf("unable to initialize plugin %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// UpdateDatasets updates each back end's view of the current dataset definitions
+func (f *fanoutWriter) UpdateDatasets(di *DsInfo) {
+	for _, t := range f.targets {
+		t.w.UpdateDatasets(di)
+	}
+}
+
+// WritePPStats writes the workloads to every back end
+func (f *fanoutWriter) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	return f.write(ctx, f.targets, func(ctx context.Context, w DBWriter) error {
+		return w.WritePPStats(ctx, ds, stats)
+	})
+}
+
+// WriteClusterStats writes the stats to every back end
+func (f *fanoutWriter) WriteClusterStats(ctx context.Context, stats []ClusterStat) error {
+	return f.write(ctx, f.targets, func(ctx context.Context, w DBWriter) error {
+		return w.WriteClusterStats(ctx, stats)
+	})
+}
+
+// targetsNamed returns the targets for the named back ends
+func (f *fanoutWriter) targetsNamed(names []string) []*fanoutTarget {
+	var targets []*fanoutTarget
+	for _, t := range f.targets {
+		if slices.Contains(names, t.name) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// write calls fn concurrently for each of the targets that has no writes
+// queued. If it succeeds for any of them, it is queued for retry on the
+// others and write returns nil. Otherwise nothing is queued and the errors
+// are returned.
+func (f *fanoutWriter) write(ctx context.Context, targets []*fanoutTarget, fn func(context.Context, DBWriter) error) error {
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		t.mu.Lock()
+		queued := len(t.queue)
+		t.mu.Unlock()
+		if queued > 0 {
+			errs[i] = fmt.Errorf("%d earlier writes waiting to be retried", queued)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.writeTarget(ctx, t, fn)
+		}()
+	}
+	wg.Wait()
+	if slices.Contains(errs, nil) {
+		f.enqueue(targets, errs, fn)
+		return nil
+	}
+	for i, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			errs[i] = fmt.Errorf("%s: %w", targets[i].name, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeTarget calls fn for one back end and records whether it failed
+func (f *fanoutWriter) writeTarget(ctx context.Context, t *fanoutTarget, fn func(context.Context, DBWriter) error) error {
+	err := fn(ctx, t.w)
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		if t.failures > 0 {
+			log.Info("Back end is accepting writes again", slog.String("processor", t.name))
+		}
+		t.failures = 0
+		return nil
+	}
+	t.failures++
+	if t.failures == 1 {
+		log.Error("Back end write failed, retrying it while continuing with the other back ends",
+			slog.String("processor", t.name),
+			slog.Any("error", err))
+	} else {
+		log.Warn("Back end write failed again",
+			slog.String("processor", t.name),
+			slog.Int("failures", t.failures),
+			slog.Any("error", err))
+	}
+	return err
+}
+
+// enqueue queues fn for retry on each target whose error is set
+func (f *fanoutWriter) enqueue(targets []*fanoutTarget, errs []error, fn func(context.Context, DBWriter) error) {
+	for i, t := range targets {
+		if errs[i] != nil && !errors.Is(errs[i], context.Canceled) {
+			f.enqueueTarget(t, fn)
+		}
+	}
+}
+
+// enqueueTarget queues fn for retry on a target, starting a goroutine to retry
+// the target's queue if there is none. The write is dropped if the queue is
+// full.
+func (f *fanoutWriter) enqueueTarget(t *fanoutTarget, fn func(context.Context, DBWriter) error) {
+	t.mu.Lock()
+	if len(t.queue) >= fanoutMaxQueued {
+		t.mu.Unlock()
+		log.Error("Too many writes waiting to be retried on back end, dropping this one",
+			slog.String("processor", t.name),
+			slog.Int("queued", fanoutMaxQueued))
+		return
+	}
+	t.queue = append(t.queue, fanoutJob{fn: fn})
+	start := !t.draining
+	t.draining = true
+	t.mu.Unlock()
+	if start {
+		go f.drain(t)
+	}
+}
+
+// retryDelay returns the delay before retrying a back end after its
+// consecutive failures
+func (f *fanoutWriter) retryDelay(failures int) time.Duration {
+	return min(time.Duration(f.gc.ProcessorRetryIntvl)*time.Second<<min(max(failures-1, 0), 16), fanoutMaxRetryIntvl)
+}
+
+// drain retries the writes queued for a target in order until the queue is
+// empty or the sink is shut down. A write that fails stats_processor_max_retries
+// more times is dropped.
+func (f *fanoutWriter) drain(t *fanoutTarget) {
+	f.mu.Lock()
+	ctx := f.ctx
+	f.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 || ctx.Err() != nil {
+			t.draining = false
+			t.mu.Unlock()
+			return
+		}
+		job, failures := t.queue[0], t.failures
+		t.mu.Unlock()
+
+		if failures > 0 && !sleepUntil(ctx, time.Now().Add(f.retryDelay(failures))) {
+			continue
+		}
+		err := f.writeTarget(ctx, t, job.fn)
+		if ctx.Err() != nil {
+			continue
+		}
+		job.attempts++
+		done := err == nil || job.attempts >= max(f.gc.ProcessorMaxRetries, 1)
+		if !done {
+			t.mu.Lock()
+			t.queue[0] = job
+			t.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			log.Error("Back end write failed too many times, dropping it",
+				slog.String("processor", t.name),
+				slog.Int("attempts", job.attempts),
+				slog.Any("error", err))
+		}
+		t.mu.Lock()
+		t.queue = t.queue[1:]
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSink is a recordingSink that counts its WritePPStats calls
+type countingSink struct {
+	*recordingSink
+	attempts atomic.Int32
+}
+
+func (s *countingSink) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	s.attempts.Add(1)
+	return s.recordingSink.WritePPStats(ctx, ds, stats)
+}
+
+// waitFor polls until cond is true, failing the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFanoutWriter(t *testing.T) {
+	ctx := context.Background()
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	good := &countingSink{recordingSink: newRecordingSink()}
+	bad := &countingSink{recordingSink: newRecordingSink()}
+	bad.fail = errors.New("backend down")
+	gc := globalConfig{ProcessorMaxRetries: 3, ProcessorRetryIntvl: 1}
+	f := newFanoutWriter([]string{"good", "bad"}, []DBWriter{good, bad}, gc)
+
+	f.UpdateDatasets(&DsInfo{Datasets: []DsInfoEntry{ds}})
+	if len(good.datasets) != 1 || len(bad.datasets) != 1 {
+		t.Error("UpdateDatasets not passed to every back end")
+	}
+
+	// a failing back end neither fails the write nor delays or duplicates the
+	// write to the other
+	start := time.Now()
+	if err := writePPStats(ctx, &Cluster{}, f, ds, spoolBatch(100), gc); err != nil {
+		t.Fatalf("writePPStats failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("write took %v, want the failing back end not to hold it up", elapsed)
+	}
+	if got := good.attempts.Load(); got != 1 {
+		t.Errorf("healthy back end written %d times, want 1", got)
+	}
+	if got := bad.attempts.Load(); got != 1 {
+		t.Errorf("failing back end tried %d times, want 1", got)
+	}
+	if !f.targets[1].down() {
+		t.Error("failing back end not marked down")
+	}
+
+	// later writes are queued behind the failed one
+	if err := f.WritePPStats(ctx, ds, spoolBatch(101)); err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+	if got := bad.attempts.Load(); got != 1 {
+		t.Errorf("failing back end tried %d times, want the write queued", got)
+	}
+	if got := len(good.written["nfs_users"]); got != 2 {
+		t.Errorf("healthy back end wrote %d workloads, want 2", got)
+	}
+
+	// once it recovers, the queued writes are retried in order
+	bad.mu.Lock()
+	bad.fail = nil
+	bad.mu.Unlock()
+	waitFor(t, 5*time.Second, func() bool { return !f.targets[1].down() })
+	bad.mu.Lock()
+	written := bad.written["nfs_users"]
+	bad.mu.Unlock()
+	if len(written) != 2 || written[0].UnixTime != 100 || written[1].UnixTime != 101 {
+		t.Errorf("recovered back end wrote %+v, want the queued workloads in order", written)
+	}
+	if err := f.WritePPStats(ctx, ds, spoolBatch(102)); err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+	// the failed write, the two queued ones and the new one
+	if got := bad.attempts.Load(); got != 4 {
+		t.Errorf("recovered back end tried %d times, want 4", got)
+	}
+
+	t.Run("retries are limited", func(t *testing.T) {
+		gc := globalConfig{ProcessorMaxRetries: 2, ProcessorRetryIntvl: 0}
+		good := &countingSink{recordingSink: newRecordingSink()}
+		bad := &countingSink{recordingSink: newRecordingSink()}
+		bad.fail = errors.New("backend down")
+		f := newFanoutWriter([]string{"good", "bad"}, []DBWriter{good, bad}, gc)
+		if err := f.WritePPStats(ctx, ds, spoolBatch(100)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		waitFor(t, 5*time.Second, func() bool {
+			f.targets[1].mu.Lock()
+			defer f.targets[1].mu.Unlock()
+			return len(f.targets[1].queue) == 0
+		})
+		// the first attempt, then two retries before the write is dropped
+		if got := bad.attempts.Load(); got != 3 {
+			t.Errorf("failing back end tried %d times, want 3", got)
+		}
+	})
+
+	t.Run("all back ends fail", func(t *testing.T) {
+		gc := globalConfig{ProcessorMaxRetries: 3, ProcessorRetryIntvl: 0}
+		a := &countingSink{recordingSink: newRecordingSink()}
+		b := &countingSink{recordingSink: newRecordingSink()}
+		a.fail, b.fail = errors.New("a down"), errors.New("b down")
+		f := newFanoutWriter([]string{"a", "b"}, []DBWriter{a, b}, gc)
+		err := writePPStats(ctx, &Cluster{}, f, ds, spoolBatch(100), gc)
+		if !errors.Is(err, errSinkWrite) || !errors.Is(err, a.fail) || !errors.Is(err, b.fail) {
+			t.Errorf("writePPStats error = %v, want errSinkWrite wrapping both failures", err)
+		}
+		// with every back end down, none is skipped, so each retry tries both
+		if a.attempts.Load() != 3 || b.attempts.Load() != 3 {
+			t.Errorf("back ends tried %d and %d times, want 3 each", a.attempts.Load(), b.attempts.Load())
+		}
+	})
+}
+
+func TestNewStatsSink(t *testing.T) {
+	c := &Cluster{ClusterName: "test"}
+	clusters := []clusterConf{{Hostname: "c1.example.com"}}
+	ss, err := newStatsSink(c, &tomlConfig{Global: globalConfig{Processor: discardPluginName}, Clusters: clusters}, 0)
+	if err != nil {
+		t.Fatalf("newStatsSink failed: %v", err)
+	}
+	if _, ok := ss.(*DiscardSink); !ok {
+		t.Errorf("single back end is %T, want *DiscardSink", ss)
+	}
+
+	spoolDir := t.TempDir()
+	gc := globalConfig{Processors: []string{discardPluginName, promPluginName}, SpoolDir: spoolDir,
+		SpoolMaxSize: 1, SpoolMaxAge: 60}
+	ss, err = newStatsSink(c, &tomlConfig{Global: gc, Clusters: clusters}, 0)
+	if err != nil {
+		t.Fatalf("newStatsSink failed: %v", err)
+	}
+	f, ok := ss.(*fanoutWriter)
+	if !ok || len(f.targets) != 2 {
+		t.Fatalf("several back ends gave %T, want a fanoutWriter for both", ss)
+	}
+	for _, name := range gc.Processors {
+		if _, err := os.Stat(filepath.Join(spoolDir, "c1.example.com", name)); err != nil {
+			t.Errorf("no spool directory for %s: %v", name, err)
+		}
+	}
+
+	gc = globalConfig{Processors: []string{discardPluginName, "bogus"}}
+	if _, err := newStatsSink(c, &tomlConfig{Global: gc, Clusters: clusters}, 0); err == nil {
+		t.Error("expected error for unknown back end")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	authUsersPath  = "/platform/1/auth/users"
+	authGroupsPath = "/platform/1/auth/groups"
+)
+
+// Default identity cache limits
+const (
+	defaultIdentityCacheSize = 10000
+	defaultIdentityCacheTTL  = 3600 // seconds
+)
+
+// identityKind is the type of identity being resolved
+type identityKind int
+
+const (
+	identityUser identityKind = iota
+	identityGroup
+)
+
+// identityKey identifies a user or group within an access zone. The id is in
+// the form accepted by the OneFS auth API, e.g. "UID:1234", "GID:100" or
+// "SID:S-1-5-21-...".
+type identityKey struct {
+	kind identityKind
+	zone string // empty for the default zone
+	id   string
+}
+
+// identityEntry is a cached identity lookup result. A failed lookup is cached
+// as an entry with an empty name so that it is not retried on every sample.
+type identityEntry struct {
+	key     identityKey
+	name    string
+	expires time.Time
+}
+
+// identityLookup is a lookup in progress, which concurrent lookups of the same
+// identity wait for instead of making their own request
+type identityLookup struct {
+	done chan struct{}
+	name string
+}
+
+// identityCache is a per-cluster LRU cache of user and group names, looked
+// up individually through the OneFS auth API as they are seen in workloads.
+// Entries expire after ttl and the least recently used entries are evicted
+// once the cache holds size entries. The lock is not held while a name is
+// fetched, so a slow lookup only holds up those waiting for the same identity.
+type identityCache struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	lru      *list.List // of *identityEntry, most recently used first
+	entries  map[identityKey]*list.Element
+	inflight map[identityKey]*identityLookup
+}
+
+func newIdentityCache(size int, ttl time.Duration) *identityCache {
+	return &identityCache{
+		size:     size,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[identityKey]*list.Element),
+		inflight: make(map[identityKey]*identityLookup),
+	}
+}
+
+// lookup returns the name of the user or group, or false if it cannot be resolved
+func (ic *identityCache) lookup(ctx context.Context, c *Cluster, key identityKey) (string, bool) {
+	ic.mu.Lock()
+	now := time.Now()
+	if el, ok := ic.entries[key]; ok {
+		entry := el.Value.(*identityEntry)
+		if now.Before(entry.expires) {
+			ic.lru.MoveToFront(el)
+			ic.mu.Unlock()
+			return entry.name, entry.name != ""
+		}
+		ic.lru.Remove(el)
+		delete(ic.entries, key)
+	}
+	if l, ok := ic.inflight[key]; ok {
+		ic.mu.Unlock()
+		select {
+		case <-l.done:
+			return l.name, l.name != ""
+		case <-ctx.Done():
+			return "", false
+		}
+	}
+	l := &identityLookup{done: make(chan struct{})}
+	ic.inflight[key] = l
+	ic.mu.Unlock()
+
+	expires := now.Add(ic.ttl)
+	name, err := c.GetIdentityName(ctx, key)
+	if err != nil {
+		log.Warn("unable to resolve identity", slog.String("cluster", c.name()),
+			slog.String("id", key.id), slog.String("zone", key.zone), slog.Any("error", err))
+		name = ""
+		expires = now.Add(min(ic.ttl, lookupRetryIntvl))
+	}
+	l.name = name
+
+	ic.mu.Lock()
+	delete(ic.inflight, key)
+	ic.entries[key] = ic.lru.PushFront(&identityEntry{key: key, name: name, expires: expires})
+	for ic.lru.Len() > ic.size {
+		oldest := ic.lru.Back()
+		ic.lru.Remove(oldest)
+		delete(ic.entries, oldest.Value.(*identityEntry).key)
+	}
+	ic.mu.Unlock()
+	close(l.done)
+	return name, name != ""
+}
+
+// GetIdentityName looks up the name of a user or group
+func (c *Cluster) GetIdentityName(ctx context.Context, key identityKey) (string, error) {
+	path, field := authUsersPath, "users"
+	if key.kind == identityGroup {
+		path, field = authGroupsPath, "groups"
+	}
+	path += "/" + url.PathEscape(key.id)
+	if key.zone != "" {
+		path += "?zone=" + url.QueryEscape(key.zone)
+	}
+	res, err := c.restGet(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	var resp map[string][]struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(res, &resp); err != nil {
+		return "", fmt.Errorf("unable to parse response for %s: %w", path, err)
+	}
+	if len(resp[field]) == 0 || resp[field][0].Name == "" {
+		return "", fmt.Errorf("no %s found for %s", field, key.id)
+	}
+	return resp[field][0].Name, nil
+}
+
+// identityZone returns the access zone to resolve a workload's identities
+// in, or an empty string for the default zone
+func identityZone(ctx context.Context, cluster *Cluster, ppstat PPStatResult) string {
+	switch {
+	case ppstat.ZoneName != nil:
+		return *ppstat.ZoneName
+	case ppstat.ZoneID != nil && cluster.zones != nil:
+		if zone, found := cluster.zones.lookup(ctx, cluster, *ppstat.ZoneID); found {
+			return zone.Name
+		}
+	}
+	return ""
+}
+
+// identityTags sets the tag named nameTag to id, or to the resolved name of
+// id if identity lookup is enabled, in which case id is also kept in idTag
+func identityTags(ctx context.Context, tags ptTags, cluster *Cluster, ppstat PPStatResult,
+	kind identityKind, id string, nameTag string, idTag string) {
+	tags[nameTag] = id
+	if cluster == nil || cluster.identities == nil {
+		return
+	}
+	tags[idTag] = id
+	key := identityKey{kind: kind, zone: identityZone(ctx, cluster, ppstat), id: id}
+	if name, found := cluster.identities.lookup(ctx, cluster, key); found {
+		tags[nameTag] = name
+	}
+}
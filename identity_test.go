@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setIdentity serves a user or group lookup result from the fake server
+func setIdentity(f *fakePAPI, path string, field string, id string, zone string, name string) {
+	if zone != "" {
+		id += "?zone=" + zone
+	}
+	f.setJSON(path+"/"+id, map[string]any{field: []map[string]any{{"name": name}}})
+}
+
+func TestTagsForPPStatIdentityLookup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	c.identities = newIdentityCache(100, time.Hour)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	setIdentity(f, authUsersPath, "users", "UID:2001", "", "bob")
+	setIdentity(f, authUsersPath, "users", "UID:2001", "Tenant", "tenant-bob")
+	setIdentity(f, authUsersPath, "users", "SID:S-1-5-21-1-2-3-1001", "", "CORP\\carol")
+	setIdentity(f, authGroupsPath, "groups", "GID:100", "", "users")
+
+	tests := []struct {
+		name   string
+		stat   PPStatResult
+		tags   map[string]string
+		absent []string
+	}{
+		{"uid", PPStatResult{UserID: intPtr(2001)},
+			map[string]string{"username": "bob", "user_id": "UID:2001"}, nil},
+		{"uid in zone", PPStatResult{UserID: intPtr(2001), ZoneName: strPtr("Tenant")},
+			map[string]string{"username": "tenant-bob", "user_id": "UID:2001"}, nil},
+		{"user sid", PPStatResult{UserSid: strPtr("S-1-5-21-1-2-3-1001")},
+			map[string]string{"username": "CORP\\carol", "user_id": "SID:S-1-5-21-1-2-3-1001"}, nil},
+		{"gid", PPStatResult{GroupID: intPtr(100)},
+			map[string]string{"groupname": "users", "group_id": "GID:100"}, nil},
+		{"unresolved", PPStatResult{UserID: intPtr(9999)},
+			map[string]string{"username": "UID:9999", "user_id": "UID:9999"}, nil},
+		{"name from workload", PPStatResult{Username: strPtr("alice")},
+			map[string]string{"username": "alice"}, []string{"user_id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := tagsForPPStat(ctx, tt.stat, c)
+			for k, want := range tt.tags {
+				if tags[k] != want {
+					t.Errorf("%s = %q, want %q", k, tags[k], want)
+				}
+			}
+			for _, k := range tt.absent {
+				if _, ok := tags[k]; ok {
+					t.Errorf("unexpected %s tag %q", k, tags[k])
+				}
+			}
+		})
+	}
+
+	// resolved and unresolved identities are both cached
+	tagsForPPStat(ctx, PPStatResult{UserID: intPtr(2001)}, c)
+	tagsForPPStat(ctx, PPStatResult{UserID: intPtr(9999)}, c)
+	if got := f.hitCount(http.MethodGet, authUsersPath+"/UID:2001"); got != 2 {
+		t.Errorf("UID:2001 lookups = %d, want 2 (one per zone)", got)
+	}
+	if got := f.hitCount(http.MethodGet, authUsersPath+"/UID:9999"); got != 1 {
+		t.Errorf("UID:9999 lookups = %d, want 1", got)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c.identities = nil
+		tags := tagsForPPStat(ctx, PPStatResult{UserID: intPtr(2001)}, c)
+		if tags["username"] != "UID:2001" {
+			t.Errorf("username = %q, want %q", tags["username"], "UID:2001")
+		}
+		if _, ok := tags["user_id"]; ok {
+			t.Error("user_id should not be set when identity lookup is disabled")
+		}
+	})
+}
+
+func TestIdentityCacheLimits(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	for _, id := range []string{"UID:1", "UID:2", "UID:3"} {
+		setIdentity(f, authUsersPath, "users", id, "", "user-"+id)
+	}
+	lookups := func(id string) int { return f.hitCount(http.MethodGet, authUsersPath+"/"+id) }
+	key := func(id string) identityKey { return identityKey{kind: identityUser, id: id} }
+
+	ic := newIdentityCache(2, time.Hour)
+	ic.lookup(ctx, c, key("UID:1"))
+	ic.lookup(ctx, c, key("UID:2"))
+	ic.lookup(ctx, c, key("UID:1")) // UID:2 is now least recently used
+	ic.lookup(ctx, c, key("UID:3"))
+	if ic.lru.Len() != 2 {
+		t.Errorf("cache holds %d entries, want 2", ic.lru.Len())
+	}
+	ic.lookup(ctx, c, key("UID:1"))
+	if got := lookups("UID:1"); got != 1 {
+		t.Errorf("UID:1 lookups = %d, want 1", got)
+	}
+	ic.lookup(ctx, c, key("UID:2"))
+	if got := lookups("UID:2"); got != 2 {
+		t.Errorf("UID:2 lookups = %d, want 2 after eviction", got)
+	}
+
+	ic = newIdentityCache(10, time.Hour)
+	if name, found := ic.lookup(ctx, c, key("UID:3")); !found || name != "user-UID:3" {
+		t.Errorf("lookup = %q, %v", name, found)
+	}
+	ic.entries[key("UID:3")].Value.(*identityEntry).expires = time.Now().Add(-time.Second)
+	ic.lookup(ctx, c, key("UID:3"))
+	if got := lookups("UID:3"); got != 3 {
+		t.Errorf("UID:3 lookups = %d, want 3 after expiry", got)
+	}
+}
+
+func TestIdentityCacheConcurrentLookups(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	setIdentity(f, authUsersPath, "users", "UID:1", "", "slow")
+	setIdentity(f, authUsersPath, "users", "UID:2", "", "fast")
+	f.inject(fakeFault{Path: authUsersPath + "/UID:1", Count: -1, Delay: 500 * time.Millisecond})
+	key := func(id string) identityKey { return identityKey{kind: identityUser, id: id} }
+
+	ic := newIdentityCache(10, time.Hour)
+	var wg sync.WaitGroup
+	names := make([]string, 5)
+	for i := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			names[i], _ = ic.lookup(ctx, c, key("UID:1"))
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// a slow lookup does not hold up lookups of other identities
+	start := time.Now()
+	if name, found := ic.lookup(ctx, c, key("UID:2")); !found || name != "fast" {
+		t.Errorf("lookup UID:2 = %q, %v", name, found)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("lookup UID:2 took %v while UID:1 was being looked up", d)
+	}
+
+	wg.Wait()
+	for i, name := range names {
+		if name != "slow" {
+			t.Errorf("lookup %d of UID:1 = %q, want %q", i, name, "slow")
+		}
+	}
+	if got := f.hitCount(http.MethodGet, authUsersPath+"/UID:1"); got != 1 {
+		t.Errorf("UID:1 lookups = %d, want 1 for concurrent lookups", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"strconv"
 	"time"
 
@@ -12,16 +13,17 @@ import (
 
 // InfluxDBSink defines the data to allow us talk to an InfluxDB database
 type InfluxDBSink struct {
+	instance    string // name of the [influxdb.<name>] section, or "" for [influxdb]
 	clusterName string
 	cluster     *Cluster // needed to enable per-cluster export id lookup
 	client      client.Client
 	bpConfig    client.BatchPointsConfig
-	exports     exportMap
 }
 
-// GetInfluxDBWriter returns an InfluxDB DBWriter
-func GetInfluxDBWriter() DBWriter {
-	return &InfluxDBSink{}
+// GetInfluxDBWriter returns an InfluxDB DBWriter for the named instance, or the
+// unnamed instance if instance is empty
+func GetInfluxDBWriter(instance string) DBWriter {
+	return &InfluxDBSink{instance: instance}
 }
 
 // Init initializes an InfluxDBSink so that points can be written
@@ -30,7 +32,7 @@ func (s *InfluxDBSink) Init(ctx context.Context, cluster *Cluster, config *tomlC
 	s.cluster = cluster
 	var username, password string
 	var err error
-	ic := config.InfluxDB
+	ic := config.influxDBInstance(s.instance)
 	url := "http://" + ic.Host + ":" + ic.Port
 
 	s.bpConfig = client.BatchPointsConfig{
@@ -63,8 +65,10 @@ func (s *InfluxDBSink) Init(ctx context.Context, cluster *Cluster, config *tomlC
 	log.Log(ctx, LevelNotice, "successfully connected to InfluxDB",
 		slog.String("response", response),
 		slog.Duration("response_time", responseTime))
+	if s.client != nil {
+		s.client.Close()
+	}
 	s.client = dbClient
-	s.exports = newExportMap(config.Global.LookupExportIDs)
 	return nil
 }
 
@@ -85,7 +89,7 @@ func (s *InfluxDBSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppstats
 		fields := fieldsForPPStat(ppstat)
 		log.Debug("got fields", slog.Any("fields", fields))
 
-		tags := tagsForPPStat(ctx, ppstat, s.cluster, s.exports)
+		tags := tagsForPPStat(ctx, ppstat, s.cluster)
 		tags["cluster"] = s.clusterName
 		tags["node"] = strconv.Itoa(ppstat.Node)
 		log.Debug("got tags", slog.Any("tags", tags))
@@ -105,3 +109,30 @@ func (s *InfluxDBSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppstats
 	}
 	return nil
 }
+
+// WriteClusterStats takes an array of ClusterStats and writes them to InfluxDB,
+// each as a measurement named after the stat with a single "value" field.
+func (s *InfluxDBSink) WriteClusterStats(ctx context.Context, stats []ClusterStat) error {
+	bp, err := client.NewBatchPoints(s.bpConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create InfluxDB batch points: %w", err)
+	}
+	for _, stat := range stats {
+		tags := maps.Clone(stat.Tags)
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["cluster"] = s.clusterName
+		fields := map[string]any{"value": stat.Value}
+		pt, err := client.NewPoint(stat.Name, tags, fields, time.Unix(stat.Time, 0).UTC())
+		if err != nil {
+			log.Warn("failed to create point", slog.String("key", stat.Name))
+			continue
+		}
+		bp.AddPoint(pt)
+	}
+	if err := s.client.Write(bp); err != nil {
+		return fmt.Errorf("failed to write batch of points: %w", err)
+	}
+	return nil
+}
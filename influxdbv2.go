@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"strconv"
 	"time"
 
@@ -14,16 +15,17 @@ import (
 
 // InfluxDBv2Sink defines the data to allow us talk to an InfluxDBv2 database
 type InfluxDBv2Sink struct {
+	instance    string // name of the [influxdbv2.<name>] section, or "" for [influxdbv2]
 	clusterName string
 	cluster     *Cluster // needed to enable per-cluster export id lookup
 	c           influxdb2.Client
 	writeAPI    api.WriteAPIBlocking
-	exports     exportMap
 }
 
-// GetInfluxDBv2Writer returns an InfluxDBv2 DBWriter
-func GetInfluxDBv2Writer() DBWriter {
-	return &InfluxDBv2Sink{}
+// GetInfluxDBv2Writer returns an InfluxDBv2 DBWriter for the named instance, or the
+// unnamed instance if instance is empty
+func GetInfluxDBv2Writer(instance string) DBWriter {
+	return &InfluxDBv2Sink{instance: instance}
 }
 
 // Init initializes an InfluxDBSink so that points can be written
@@ -31,7 +33,7 @@ func (s *InfluxDBv2Sink) Init(ctx context.Context, cluster *Cluster, config *tom
 	s.clusterName = cluster.ClusterName
 	s.cluster = cluster
 	var err error
-	ic := config.InfluxDBv2
+	ic := config.influxDBv2Instance(s.instance)
 	url := "http://" + ic.Host + ":" + ic.Port
 
 	token := ic.Token
@@ -54,10 +56,11 @@ func (s *InfluxDBv2Sink) Init(ctx context.Context, cluster *Cluster, config *tom
 		return fmt.Errorf("InfluxDBv2 ping failed - server not reachable")
 	}
 	log.Log(ctx, LevelNotice, "successfully connected to InfluxDBv2", slog.String("cluster", cluster.ClusterName))
+	if s.c != nil {
+		s.c.Close()
+	}
 	s.c = client
 	s.writeAPI = client.WriteAPIBlocking(ic.Org, ic.Bucket)
-
-	s.exports = newExportMap(config.Global.LookupExportIDs)
 	return nil
 }
 
@@ -75,7 +78,7 @@ func (s *InfluxDBv2Sink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppsta
 		fields := fieldsForPPStat(ppstat)
 		log.Debug("got fields", slog.Any("fields", fields))
 
-		tags := tagsForPPStat(ctx, ppstat, s.cluster, s.exports)
+		tags := tagsForPPStat(ctx, ppstat, s.cluster)
 		tags["cluster"] = s.clusterName
 		tags["node"] = strconv.Itoa(ppstat.Node)
 		log.Debug("got tags", slog.Any("tags", tags))
@@ -87,3 +90,22 @@ func (s *InfluxDBv2Sink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppsta
 	}
 	return nil
 }
+
+// WriteClusterStats takes an array of ClusterStats and writes them to InfluxDB,
+// each as a measurement named after the stat with a single "value" field.
+func (s *InfluxDBv2Sink) WriteClusterStats(ctx context.Context, stats []ClusterStat) error {
+	var pts []*write.Point
+	for _, stat := range stats {
+		tags := maps.Clone(stat.Tags)
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["cluster"] = s.clusterName
+		fields := map[string]any{"value": stat.Value}
+		pts = append(pts, influxdb2.NewPoint(stat.Name, tags, fields, time.Unix(stat.Time, 0).UTC()))
+	}
+	if err := s.writeAPI.WritePoint(ctx, pts...); err != nil {
+		return fmt.Errorf("InfluxDBv2 write failed: %w", err)
+	}
+	return nil
+}
@@ -3,17 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,11 +30,6 @@ import (
 // MaxAPIPathLen is the limit on the length of an API request URL
 const MaxAPIPathLen = 8198
 
-// MaxDsID is the maximum dataset ID supported by the API; for OneFS releases
-// up to and including 9.12, the API supports the System dataset (0) and up to
-// four user-defined datasets.
-const MaxDsID = 4
-
 // AuthInfo provides username and password to authenticate
 // against the OneFS API
 type AuthInfo struct {
@@ -39,18 +41,55 @@ type AuthInfo struct {
 // cluster via the OneFS API
 type Cluster struct {
 	AuthInfo
-	AuthType     string
-	Hostname     string
-	Port         int
-	VerifySSL    bool
-	OSVersion    string
-	ClusterName  string
-	baseURL      string
-	client       *http.Client
-	csrfToken    string
-	reauthTime   time.Time
-	maxRetries   int
-	PreserveCase bool
+	AuthType      string
+	Hostname      string
+	FailoverHosts []string // additional node names/addresses to try if Hostname is unavailable
+	Port          int
+	Scheme        string
+	VerifySSL     bool
+	// optional TLS settings; see tlsConfig
+	CAFile       string
+	ClientCert   string
+	ClientKey    string
+	ServerName   string
+	Fingerprints []string
+	// transport tuning; zero values leave the net/http defaults in place
+	// except for RequestTimeout where zero means no timeout
+	ConnectTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	RequestTimeout      time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	OSVersion           string
+	ClusterName         string
+	Nodes               []int         // logical node numbers, from the cluster config
+	caps                *Capabilities // platform API capabilities, nil until probed
+	perfSettings        PerformanceSettings
+	endpoints           []string // host:port for Hostname followed by each of FailoverHosts
+	client              *http.Client
+	retry               retryPolicy
+	pollInterval        time.Duration         // how often workloads are collected
+	perNode             bool                  // collect workloads from each node separately
+	nodeConcurrency     int                   // maximum concurrent per-node requests
+	datasets            *datasetFilter        // datasets to collect, nil for all
+	datasetParams       map[string]url.Values // extra workload query parameters, keyed by dataset name
+	exports             *exportCache          // NFS export lookup, nil if disabled
+	shares              *shareCache           // SMB share lookup, nil if disabled
+	zones               *zoneCache            // access zone id lookup, nil if disabled
+	identities          *identityCache        // user and group name lookup, nil if disabled
+	PreserveCase        bool
+
+	// mu protects the connection state below, which is shared by concurrent
+	// requests. gen is incremented whenever the endpoint or session changes.
+	mu          sync.Mutex
+	baseURL     string
+	curEndpoint int
+	csrfToken   string
+	reauthTime  time.Time
+	gen         uint64
+	// authMu serializes (re)authentication
+	authMu sync.Mutex
 }
 
 // DsInfoEntry contains metadata info for a single partitioned performance dataset
@@ -121,13 +160,131 @@ type PPWorkloadQuery struct {
 	Workloads []PPStatResult `json:"workload"`
 }
 
+// PAPIErrorEntry describes a single error in the errors envelope returned by the OneFS API
+type PAPIErrorEntry struct {
+	Code    string `json:"code"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// papiErrors is the errors envelope that any OneFS API endpoint may return
+type papiErrors struct {
+	Errors []PAPIErrorEntry `json:"errors"`
+}
+
+// APIError is returned when the cluster rejects an API request. It carries the
+// HTTP status and the first error from the PAPI errors envelope, if any.
+type APIError struct {
+	Cluster    string
+	Endpoint   string
+	StatusCode int
+	Status     string
+	Code       string
+	Field      string
+	Message    string
+	Errors     []PAPIErrorEntry
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cluster %s returned HTTP %s for %s", e.Cluster, e.Status, e.Endpoint)
+	if e.Code != "" {
+		fmt.Fprintf(&sb, ": %s", e.Code)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&sb, " (field %s)", e.Field)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&sb, ": %s", e.Message)
+	}
+	return sb.String()
+}
+
+// Permanent reports whether the error will recur until something changes on
+// the cluster, such as a missing privilege or a dataset that no longer exists,
+// as opposed to a transient failure that is worth retrying
+func (e *APIError) Permanent() bool {
+	switch e.Code {
+	case "AEC_FORBIDDEN", "AEC_NOT_FOUND", "AEC_BAD_REQUEST", "AEC_ARG_REQUIRED",
+		"AEC_NOT_MODIFIED", "AEC_UNAUTHORIZED":
+		return true
+	case "AEC_TRANSIENT", "AEC_TIMEOUT", "AEC_SYSTEM_INTERNAL_ERROR", "AEC_UNAVAILABLE":
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// maxErrorBodyLen limits how much of an error response body we will read
+const maxErrorBodyLen = 64 * 1024
+
+// newAPIError builds an APIError from an unsuccessful HTTP response, decoding
+// the PAPI errors envelope from the body where possible
+func newAPIError(cluster string, endpoint string, resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+	return apiErrorFromBody(cluster, endpoint, resp.StatusCode, resp.Status, body)
+}
+
+// apiErrorFromBody builds an APIError from the given HTTP status and response body
+func apiErrorFromBody(cluster string, endpoint string, statusCode int, status string, body []byte) *APIError {
+	e := &APIError{
+		Cluster:    cluster,
+		Endpoint:   endpoint,
+		StatusCode: statusCode,
+		Status:     status,
+	}
+	var pe papiErrors
+	if err := json.Unmarshal(body, &pe); err == nil && len(pe.Errors) > 0 {
+		e.setErrors(pe.Errors)
+	} else if msg := strings.TrimSpace(string(body)); msg != "" && len(msg) < 512 {
+		// not a PAPI envelope (e.g. a proxy or Apache error page), keep short bodies verbatim
+		e.Message = msg
+	}
+	return e
+}
+
+// setErrors records the entries of a PAPI errors envelope, the first of which
+// is taken as the error
+func (e *APIError) setErrors(errs []PAPIErrorEntry) {
+	e.Errors = errs
+	e.Code = errs[0].Code
+	e.Field = errs[0].Field
+	e.Message = errs[0].Message
+}
+
 const sessionPath = "/session/1/session"
 const configPath = "/platform/1/cluster/config"
 const dsPath = "/platform/10/performance/datasets"
 const ppWorkloadPath = "/platform/10/statistics/summary/workload"
 const exportPath = "/platform/1/protocols/nfs/exports"
 
-const maxTimeoutSecs = 1800 // clamp retry timeout to 30 minutes
+// logoutTimeout limits how long we wait for the cluster to delete a session
+const logoutTimeout = 10 * time.Second
+
+// setDefaults fills in defaults for any unset connection settings
+func (c *Cluster) setDefaults() {
+	if c.Port == 0 {
+		c.Port = defaultAPIPort
+	}
+	if c.Scheme == "" {
+		c.Scheme = defaultAPIScheme
+	}
+	def := defaultRetryPolicy()
+	if c.retry.maxRetries <= 0 {
+		c.retry.maxRetries = def.maxRetries
+	}
+	if c.retry.initialDelay <= 0 {
+		c.retry.initialDelay = def.initialDelay
+	}
+	if c.retry.maxDelay < c.retry.initialDelay {
+		c.retry.maxDelay = max(def.maxDelay, c.retry.initialDelay)
+	}
+}
 
 // initialize handles setting up the API client
 func (c *Cluster) initialize() error {
@@ -145,35 +302,221 @@ func (c *Cluster) initialize() error {
 	if c.Hostname == "" {
 		return fmt.Errorf("hostname must be set")
 	}
-	if c.Port == 0 {
-		c.Port = 8080
-	}
+	c.setDefaults()
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		return err
 	}
+	dialer := &net.Dialer{
+		Timeout:   c.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	// DisableCompression is left false so that the transport requests gzip and
+	// transparently decompresses responses: workload responses for large
+	// datasets compress well
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: !c.VerifySSL},
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		IdleConnTimeout:     c.IdleConnTimeout,
 	}
 	c.client = &http.Client{
 		Transport: tr,
 		Jar:       jar,
+		Timeout:   c.RequestTimeout,
 	}
-	c.baseURL = "https://" + c.Hostname + ":" + strconv.Itoa(c.Port)
+	c.endpoints = nil
+	seen := make(map[string]bool)
+	for _, h := range append([]string{c.Hostname}, c.FailoverHosts...) {
+		ep := c.endpointAddr(h)
+		if h == "" || seen[ep] {
+			continue
+		}
+		seen[ep] = true
+		c.endpoints = append(c.endpoints, ep)
+	}
+	c.curEndpoint = 0
+	c.baseURL = c.Scheme + "://" + c.endpoints[0]
 	return nil
 }
 
+// tlsConfig builds the TLS configuration for talking to the cluster.
+// If VerifySSL is set, the certificate chain is verified against CAFile if
+// given, otherwise the system roots. ServerName overrides the name checked
+// against the certificate, e.g. when connecting to nodes by IP address.
+// If Fingerprints is set, the cluster's leaf certificate must also match
+// one of the given SHA-256 fingerprints; this works even with VerifySSL off,
+// allowing a self-signed certificate to be pinned.
+func (c *Cluster) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		InsecureSkipVerify: !c.VerifySSL,
+		ServerName:         c.ServerName,
+	}
+	if c.CAFile != "" && !c.VerifySSL {
+		log.Warn("ca_file is ignored for cluster since verify-ssl is disabled", slog.String("cluster", c.Hostname))
+	} else if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.Fingerprints) > 0 {
+		pins := make(map[string]bool)
+		for _, fp := range c.Fingerprints {
+			pin, err := normalizeFingerprint(fp)
+			if err != nil {
+				return nil, err
+			}
+			pins[pin] = true
+		}
+		// VerifyConnection is called even when InsecureSkipVerify is set
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("cluster presented no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			fp := hex.EncodeToString(sum[:])
+			if !pins[fp] {
+				return fmt.Errorf("cluster certificate fingerprint %s does not match any pinned fingerprint", fp)
+			}
+			return nil
+		}
+	}
+	return tc, nil
+}
+
+// normalizeFingerprint converts a SHA-256 fingerprint in any of the common
+// forms (upper or lower case, optionally colon-separated) to lower-case hex
+func normalizeFingerprint(fp string) (string, error) {
+	s := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 certificate fingerprint %q", fp)
+	}
+	return s, nil
+}
+
+// endpointAddr returns the host:port address for the given host, which may
+// optionally include its own port
+func (c *Cluster) endpointAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+// endpoint returns the address of the cluster endpoint currently in use
+func (c *Cluster) endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.curEndpoint]
+}
+
+// generation returns the current connection generation, which changes
+// whenever the endpoint or session does
+func (c *Cluster) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// nextEndpoint switches to the next configured endpoint, unless another
+// request has already changed endpoint or session since generation gen.
+// It returns the new generation and whether it switched. Sessions are per
+// node so any CSRF token for the previous endpoint is discarded.
+func (c *Cluster) nextEndpoint(gen uint64) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return c.gen, false
+	}
+	c.curEndpoint = (c.curEndpoint + 1) % len(c.endpoints)
+	c.baseURL = c.Scheme + "://" + c.endpoints[c.curEndpoint]
+	c.csrfToken = ""
+	c.gen++
+	return c.gen, true
+}
+
+// sessionExpired reports whether the session is due to be renewed, along with
+// the current generation to pass to reauthenticate
+func (c *Cluster) sessionExpired() (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen, time.Now().After(c.reauthTime)
+}
+
+// shouldFailover reports whether an error talking to one endpoint suggests
+// that another node may be able to serve the request, e.g. connection
+// failures, DNS failures and timeouts
+func shouldFailover(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 // String returns the string representation of Cluster as the cluster name
 func (c *Cluster) String() string {
 	return c.ClusterName
 }
 
+// name returns the cluster name if it is known yet, otherwise the configured hostname
+func (c *Cluster) name() string {
+	if c.ClusterName != "" {
+		return c.ClusterName
+	}
+	return c.Hostname
+}
+
 // Authenticate authenticates to the cluster using the session API endpoint
 // and saves the cookies needed to authenticate subsequent requests
 func (c *Cluster) Authenticate(ctx context.Context) error {
-	var err error
-	var resp *http.Response
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.authenticate(ctx)
+}
 
+// reauthenticate establishes a new session unless another request has already
+// done so since generation gen, so that concurrent requests that find their
+// session has expired only log in once
+func (c *Cluster) reauthenticate(ctx context.Context, gen uint64) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.generation() != gen {
+		return nil
+	}
+	return c.authenticate(ctx)
+}
+
+// authenticate logs in to the cluster; the caller must hold authMu
+func (c *Cluster) authenticate(ctx context.Context) error {
 	am := struct {
 		Username string   `json:"username"`
 		Password string   `json:"password"`
@@ -187,44 +530,25 @@ func (c *Cluster) Authenticate(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	u, err := url.Parse(c.baseURL + sessionPath)
-	if err != nil {
-		return err
-	}
 	// POST our authentication request to the API
 	// This may be our first connection so we'll retry here in the hope that if
 	// we can't connect to one node, another may be responsive
-	var req *http.Request
-	retrySecs := 1
-	for i := 1; i <= c.maxRetries; i++ {
-		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewBuffer(b))
+	resp, err := c.doWithRetry(ctx, sessionPath, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(sessionPath), bytes.NewReader(b))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		req.Header.Set("User-Agent", userAgent)
 		req.Header.Set("Content-Type", "application/json")
-		resp, err = c.client.Do(req)
-		if err == nil {
-			break
-		}
-		log.Warn("Authentication request failed, retrying", slog.Any("error", err), slog.Int("retry_in_seconds", retrySecs))
-		select {
-		case <-time.After(time.Duration(retrySecs) * time.Second):
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-		retrySecs *= 2
-		if retrySecs > maxTimeoutSecs {
-			retrySecs = maxTimeoutSecs
-		}
-	}
+		return req, nil
+	}, nil)
 	if err != nil {
-		return fmt.Errorf("max retries exceeded connecting to %s: %w", c.Hostname, err)
+		return fmt.Errorf("unable to authenticate to cluster %s: %w", c.name(), err)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 	// 201(StatusCreated) is success
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("auth failed: %s", resp.Status)
+		return fmt.Errorf("auth failed: %w", newAPIError(c.name(), sessionPath, resp))
 	}
 	// parse out time limit so we can reauth when necessary
 	dec := json.NewDecoder(resp.Body)
@@ -252,20 +576,23 @@ func (c *Cluster) Authenticate(ctx context.Context) error {
 	if timeout > 60 {
 		timeout -= 60 // Give a minute's grace to the reauth timer
 	}
-	c.reauthTime = time.Now().Add(time.Duration(timeout) * time.Second)
-
-	c.csrfToken = ""
+	var csrfToken string
 	// Extract the CSRF token so we can set the appropriate header
-	for _, cookie := range c.client.Jar.Cookies(u) {
+	for _, cookie := range c.client.Jar.Cookies(resp.Request.URL) {
 		if cookie.Name == "isicsrf" {
 			log.Debug("Found csrf cookie", slog.Any("cookie", cookie))
-			c.csrfToken = cookie.Value
+			csrfToken = cookie.Value
 		}
 	}
-	if c.csrfToken == "" {
+	if csrfToken == "" {
 		log.Debug("No CSRF token found for cluster, assuming old-style session auth", slog.String("cluster", c.Hostname))
 	}
 
+	c.mu.Lock()
+	c.reauthTime = time.Now().Add(time.Duration(timeout) * time.Second)
+	c.csrfToken = csrfToken
+	c.gen++
+	c.mu.Unlock()
 	return nil
 }
 
@@ -303,6 +630,23 @@ func (c *Cluster) GetClusterConfig(ctx context.Context) error {
 	} else {
 		c.ClusterName = strings.ToLower(name)
 	}
+	devices, ok := m["devices"].([]any)
+	if !ok {
+		return fmt.Errorf("unexpected type for devices field")
+	}
+	c.Nodes = nil
+	for _, d := range devices {
+		device, ok := d.(map[string]any)
+		if !ok {
+			return fmt.Errorf("unexpected type for device entry")
+		}
+		lnn, ok := device["lnn"].(float64)
+		if !ok {
+			return fmt.Errorf("unexpected type for lnn field")
+		}
+		c.Nodes = append(c.Nodes, int(lnn))
+	}
+	slices.Sort(c.Nodes)
 	return nil
 }
 
@@ -320,189 +664,456 @@ func (c *Cluster) Connect(ctx context.Context) error {
 	if err := c.GetClusterConfig(ctx); err != nil {
 		return fmt.Errorf("get cluster config: %w", err)
 	}
+	if err := c.checkCapabilities(ctx); err != nil {
+		return fmt.Errorf("check capabilities: %w", err)
+	}
 	return nil
 }
 
-// GetDataSetInfo returns info on each of the defined data sets on the cluster
-func (c *Cluster) GetDataSetInfo(ctx context.Context) (*DsInfo, error) {
-	var di DsInfo
-	res, err := c.restGet(ctx, dsPath)
+// Logout deletes the current session, if any, so that it no longer counts
+// against the cluster's limit on concurrent sessions per user. It is safe to
+// call with a cancelled context, e.g. during shutdown.
+func (c *Cluster) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	loggedIn := !c.reauthTime.IsZero()
+	c.mu.Unlock()
+	if c.AuthType != authtypeSession || c.client == nil || !loggedIn {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), logoutTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, http.MethodDelete, sessionPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Debug("Got data set info", slog.String("response", string(res)))
-
-	err = json.Unmarshal(res, &di)
+	c.mu.Lock()
+	c.csrfToken = ""
+	c.reauthTime = time.Time{}
+	c.gen++
+	c.mu.Unlock()
+	resp, err := c.client.Do(req)
 	if err != nil {
-		log.Error("Failed to unmarshal data set info for cluster", slog.String("cluster", c.String()))
-		return nil, err
+		return fmt.Errorf("unable to log out of cluster %s: %w", c.name(), err)
 	}
-	return &di, nil
+	defer resp.Body.Close() //nolint:errcheck
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		log.Info("Logged out of cluster", slog.String("cluster", c.name()))
+	case http.StatusUnauthorized:
+		// the session has already expired
+	default:
+		return fmt.Errorf("logout failed: %w", newAPIError(c.name(), sessionPath, resp))
+	}
+	return nil
 }
 
-// GetExportPathByID returns the first defined path for the given NFS export id or an error
-func (c *Cluster) GetExportPathByID(ctx context.Context, id int) (string, error) {
-	// We only care about the paths component here, so ignore the rest
-	var exports any
-	url := fmt.Sprintf("%s/%d", exportPath, id)
-	log.Debug("fetching export info", slog.String("url", url))
-	res, err := c.restGet(ctx, url)
-	if err != nil {
-		return "", err
-	}
-	err = json.Unmarshal(res, &exports)
+// adoptSession takes over the connection and session of old, which must have
+// the same connection settings (see sameConnSettings), so that a new Cluster
+// created after a config reload can continue to use an existing session
+func (c *Cluster) adoptSession(old *Cluster) {
+	c.client = old.client
+	c.baseURL = old.baseURL
+	c.endpoints = old.endpoints
+	c.curEndpoint = old.curEndpoint
+	c.csrfToken = old.csrfToken
+	c.reauthTime = old.reauthTime
+	c.ClusterName = old.ClusterName
+	c.OSVersion = old.OSVersion
+	c.Nodes = old.Nodes
+	c.caps = old.caps
+	c.perfSettings = old.perfSettings
+}
+
+// sameConnSettings reports whether c and o are configured to connect to the
+// same cluster in the same way, with the same credentials
+func (c *Cluster) sameConnSettings(o *Cluster) bool {
+	c.setDefaults()
+	o.setDefaults()
+	return c.AuthInfo == o.AuthInfo &&
+		c.AuthType == o.AuthType &&
+		c.Hostname == o.Hostname &&
+		slices.Equal(c.FailoverHosts, o.FailoverHosts) &&
+		c.Port == o.Port &&
+		c.Scheme == o.Scheme &&
+		c.VerifySSL == o.VerifySSL &&
+		c.CAFile == o.CAFile &&
+		c.ClientCert == o.ClientCert &&
+		c.ClientKey == o.ClientKey &&
+		c.ServerName == o.ServerName &&
+		slices.Equal(c.Fingerprints, o.Fingerprints) &&
+		c.ConnectTimeout == o.ConnectTimeout &&
+		c.TLSHandshakeTimeout == o.TLSHandshakeTimeout &&
+		c.RequestTimeout == o.RequestTimeout &&
+		c.MaxIdleConns == o.MaxIdleConns &&
+		c.MaxIdleConnsPerHost == o.MaxIdleConnsPerHost &&
+		c.IdleConnTimeout == o.IdleConnTimeout &&
+		c.retry == o.retry &&
+		c.PreserveCase == o.PreserveCase
+}
+
+// GetDataSetInfo returns info on each of the defined data sets on the cluster
+func (c *Cluster) GetDataSetInfo(ctx context.Context) (*DsInfo, error) {
+	datasets, err := listAll[DsInfoEntry](ctx, c, dsPath, "datasets")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	ea1, ok := exports.(map[string]any)
-	if !ok {
-		return "", fmt.Errorf("unexpected JSON structure for export %d", id)
+	return &DsInfo{Datasets: datasets, Total: len(datasets)}, nil
+}
+
+// listAll returns every item of a PAPI collection. The items are read from
+// the JSON array named key in each response, and any resume token is followed
+// until the whole collection has been read.
+func listAll[T any](ctx context.Context, c *Cluster, path string, key string) ([]T, error) {
+	var items []T
+	seen := make(map[string]bool)
+	next := path
+	for {
+		res, err := c.restGet(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		var page map[string]json.RawMessage
+		if err := json.Unmarshal(res, &page); err != nil {
+			return nil, fmt.Errorf("unable to parse response for %s: %w", path, err)
+		}
+		var pageItems []T
+		if raw, ok := page[key]; ok {
+			if err := json.Unmarshal(raw, &pageItems); err != nil {
+				return nil, fmt.Errorf("unable to parse %s in response for %s: %w", key, path, err)
+			}
+		}
+		log.Debug("Got list page", slog.String("path", next), slog.Int("bytes", len(res)),
+			slog.Int("count", len(pageItems)))
+		items = append(items, pageItems...)
+		var resume string
+		if raw, ok := page["resume"]; ok {
+			// resume is null on the last page
+			if err := json.Unmarshal(raw, &resume); err != nil {
+				return nil, fmt.Errorf("unable to parse resume token for %s: %w", path, err)
+			}
+		}
+		if resume == "" {
+			return items, nil
+		}
+		if seen[resume] {
+			return nil, fmt.Errorf("cluster returned a repeated resume token for %s", path)
+		}
+		seen[resume] = true
+		// the resume token encodes the original query so no other arguments are allowed
+		base, _, _ := strings.Cut(path, "?")
+		next = base + "?resume=" + url.QueryEscape(resume)
 	}
-	ea2, ok := ea1["exports"].([]any)
-	if !ok || len(ea2) == 0 {
-		return "", fmt.Errorf("unexpected type or empty exports field for export %d", id)
+}
+
+// workloadBatchSize is the number of workloads passed to the caller at a time
+// when streaming a workload response
+const workloadBatchSize = 1000
+
+// StreamPPStats queries the API for the specified Partitioned Performance data
+// set and decodes the response as it is read, passing the workloads to fn in
+// batches of up to workloadBatchSize, so that a large response is never held
+// in memory all at once. It returns the number of workloads read. If fn
+// returns an error, the rest of the response is abandoned and that error is
+// returned.
+func (c *Cluster) StreamPPStats(ctx context.Context, dsName string, fn func([]PPStatResult) error) (int, error) {
+	log.Info("fetching PP stats from cluster", slog.String("cluster", c.String()))
+	return c.streamPPStats(ctx, dsName, c.workloadQuery(dsName), fn)
+}
+
+// NodeStatus records whether a node returned workload data
+type NodeStatus struct {
+	Node int
+	Up   bool
+}
+
+// GetPPStatsByNode queries each node of the cluster separately for the
+// specified data set, with at most nodeConcurrency queries in flight, and
+// returns the merged results along with the status of each node. An error is
+// returned only if no node returned any data.
+func (c *Cluster) GetPPStatsByNode(ctx context.Context, dsName string) ([]PPStatResult, []NodeStatus, error) {
+	log.Info("fetching PP stats from each node of cluster",
+		slog.String("cluster", c.String()),
+		slog.Int("nodes", len(c.Nodes)))
+	type nodeResult struct {
+		stats []PPStatResult
+		err   error
 	}
-	export, ok := ea2[0].(map[string]any)
-	if !ok {
-		return "", fmt.Errorf("unexpected type for export entry %d", id)
+	nodeResults := make([]nodeResult, len(c.Nodes))
+	sem := make(chan struct{}, max(c.nodeConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, lnn := range c.Nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				nodeResults[i].err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			q := c.workloadQuery(dsName)
+			q.Set("nodes", strconv.Itoa(lnn))
+			// we want an error rather than an empty result if the node is down
+			q.Set("degraded", "false")
+			nodeResults[i].stats, nodeResults[i].err = c.getPPStats(ctx, dsName, q)
+		}()
 	}
-	paths := export["paths"]
-	if paths == nil {
-		return "", fmt.Errorf("no paths found for export id %d", id)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
 	}
-	pathList, ok := paths.([]any)
-	if !ok || len(pathList) == 0 {
-		return "", fmt.Errorf("unexpected type or empty paths for export id %d", id)
+
+	var results []PPStatResult
+	var firstErr error
+	up := 0
+	nodes := make([]NodeStatus, len(c.Nodes))
+	for i, nr := range nodeResults {
+		nodes[i] = NodeStatus{Node: c.Nodes[i], Up: nr.err == nil}
+		if nr.err != nil {
+			log.Warn("Node did not return workload data",
+				slog.String("cluster", c.String()),
+				slog.String("dataset", dsName),
+				slog.Int("node", c.Nodes[i]),
+				slog.Any("error", nr.err))
+			if firstErr == nil {
+				firstErr = nr.err
+			}
+			continue
+		}
+		up++
+		results = append(results, nr.stats...)
 	}
-	// Just return the first path, even if there are multiple
-	path, ok := pathList[0].(string)
-	if !ok {
-		return "", fmt.Errorf("unexpected type for path entry in export id %d", id)
+	if up == 0 {
+		return nil, nodes, firstErr
 	}
-	return path, nil
+	return results, nodes, nil
 }
 
-// GetPPStats queries the API for the specified Partitioned Performance data set and returns
-// an array of PPStatResult structures representing that set
-func (c *Cluster) GetPPStats(ctx context.Context, dsName string) ([]PPStatResult, error) {
+// getPPStats fetches and parses a single workload query
+func (c *Cluster) getPPStats(ctx context.Context, dsName string, q url.Values) ([]PPStatResult, error) {
 	var results []PPStatResult
-
-	basePath := ppWorkloadPath + "?degraded=true&nodes=all&dataset=" + dsName
-	log.Info("fetching PP stats from cluster", slog.String("cluster", c.String()))
-	resp, err := c.restGet(ctx, basePath)
+	_, err := c.streamPPStats(ctx, dsName, q, func(batch []PPStatResult) error {
+		results = append(results, batch...)
+		return nil
+	})
 	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// streamPPStats fetches a single workload query, decoding it as it is read
+func (c *Cluster) streamPPStats(ctx context.Context, dsName string, q url.Values,
+	fn func([]PPStatResult) error) (int, error) {
+	basePath := ppWorkloadPath + "?" + q.Encode()
+	var n int
+	var decodeErr, fnErr error
+	err := c.restGetStream(ctx, basePath, func(body io.Reader) error {
+		n, decodeErr = decodePPStats(body, workloadBatchSize, func(batch []PPStatResult) error {
+			fnErr = fn(batch)
+			return fnErr
+		})
+		return decodeErr
+	})
+	switch {
+	case fnErr != nil:
+		return n, fnErr
+	case decodeErr != nil:
+		var apiErr *APIError
+		if errors.As(decodeErr, &apiErr) {
+			apiErr.Cluster = c.name()
+			apiErr.Endpoint = basePath
+		}
+		log.Error("Unable to parse stat response", slog.Any("error", decodeErr))
+		return n, decodeErr
+	case err != nil:
 		log.Error("Attempt to retrieve workload data failed",
 			slog.String("cluster", c.String()),
 			slog.String("dataset", dsName),
 			slog.Any("error", err))
-		return nil, err
-	}
-	log.Debug("workload response", slog.String("response", string(resp)))
-	// Parse the result
-	results, err = parsePPStatResult(resp)
-	if err != nil {
-		log.Error("Unable to parse stat response", slog.Any("error", err))
-		return nil, err
+		return n, err
 	}
+	log.Debug("decoded workload response", slog.String("dataset", dsName), slog.Int("count", n))
+	return n, nil
+}
 
-	return results, nil
+// workloadQuery returns the query parameters for fetching the given dataset.
+// By default we ask for data from all nodes, even if some are down, and any
+// dataset_params configured for the dataset are applied on top.
+func (c *Cluster) workloadQuery(dsName string) url.Values {
+	q := url.Values{
+		"degraded": {"true"},
+		"nodes":    {"all"},
+	}
+	for k, v := range c.datasetParams[dsName] {
+		q[k] = v
+	}
+	q.Set("dataset", dsName)
+	return q
 }
 
 // parsePPStatResult unmarshals the JSON response from the partitioned-performance workload
-// endpoint and returns the workloads as an array of PPStatResult structures
+// endpoint and returns the workloads as an array of PPStatResult structures.
+// If the response is a PAPI errors envelope, an *APIError is returned.
 func parsePPStatResult(res []byte) ([]PPStatResult, error) {
-	// XXX need to handle errors response here!
-	workloads := PPWorkloadQuery{}
-	err := json.Unmarshal(res, &workloads)
+	var results []PPStatResult
+	_, err := decodePPStats(bytes.NewReader(res), workloadBatchSize, func(batch []PPStatResult) error {
+		results = append(results, batch...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return workloads.Workloads, nil
+	return results, nil
 }
 
-// isConnectionRefused checks if the given error is a connection refused error
-func isConnectionRefused(err error) bool {
-	return errors.Is(err, syscall.ECONNREFUSED)
+// decodePPStats decodes a partitioned-performance workload response as it is
+// read from r, passing the workloads to fn in batches of up to batchSize. fn
+// is called at least once, with an empty batch if there are no workloads. It
+// returns the number of workloads decoded. If the response is a PAPI errors
+// envelope, an *APIError is returned.
+func decodePPStats(r io.Reader, batchSize int, fn func([]PPStatResult) error) (int, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return 0, err
+	} else if tok != json.Delim('{') {
+		return 0, fmt.Errorf("unexpected %v at start of workload response", tok)
+	}
+	n := 0
+	batch := make([]PPStatResult, 0, batchSize)
+	var papiErrs []PAPIErrorEntry
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return n, err
+		}
+		switch key {
+		case "workload":
+			tok, err := dec.Token()
+			if err != nil {
+				return n, err
+			}
+			if tok == nil {
+				continue
+			}
+			if tok != json.Delim('[') {
+				return n, fmt.Errorf("unexpected %v for workload field", tok)
+			}
+			for dec.More() {
+				var w PPStatResult
+				if err := dec.Decode(&w); err != nil {
+					return n, err
+				}
+				batch = append(batch, w)
+				n++
+				if len(batch) == batchSize {
+					if err := fn(batch); err != nil {
+						return n, err
+					}
+					// fn may hold on to the batch
+					batch = make([]PPStatResult, 0, batchSize)
+				}
+			}
+			// closing bracket of the workload array
+			if _, err := dec.Token(); err != nil {
+				return n, err
+			}
+		case "errors":
+			if err := dec.Decode(&papiErrs); err != nil {
+				return n, err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return n, err
+			}
+		}
+	}
+	// closing brace of the response
+	if _, err := dec.Token(); err != nil {
+		return n, err
+	}
+	if len(papiErrs) > 0 {
+		e := &APIError{Endpoint: ppWorkloadPath, StatusCode: http.StatusOK, Status: "200 OK"}
+		e.setErrors(papiErrs)
+		return n, e
+	}
+	if len(batch) > 0 || n == 0 {
+		if err := fn(batch); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
 }
 
 // restGet returns the REST response for the given endpoint from the API
 func (c *Cluster) restGet(ctx context.Context, endpoint string) ([]byte, error) {
-	var err error
-	var resp *http.Response
-
-	if c.AuthType == authtypeSession && time.Now().After(c.reauthTime) {
-		log.Info("re-authenticating to cluster based on timer", slog.String("cluster", c.String()))
-		if err = c.Authenticate(ctx); err != nil {
-			return nil, err
-		}
-	}
+	var body []byte
+	err := c.restGetStream(ctx, endpoint, func(r io.Reader) error {
+		var err error
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return body, err
+}
 
-	u, err := url.Parse(c.baseURL + endpoint)
-	if err != nil {
-		return nil, err
-	}
-	req, err := c.newGetRequest(ctx, u.String())
+// restGetStream requests the given endpoint from the API and passes the
+// response body to fn, which may read it as it arrives
+func (c *Cluster) restGetStream(ctx context.Context, endpoint string, fn func(io.Reader) error) error {
+	endpoint, err := c.apiPath(endpoint)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	retrySecs := 1
-	for i := 1; i <= c.maxRetries; i++ {
-		resp, err = c.client.Do(req)
-		if err == nil {
-			// We got a valid http response
-			if resp.StatusCode == http.StatusOK {
-				break
-			}
-			_ = resp.Body.Close()
-			// check for need to re-authenticate (maybe we are talking to a different node)
-			if resp.StatusCode == http.StatusUnauthorized {
-				if c.AuthType == authtypeBasic {
-					return nil, fmt.Errorf("basic authentication for cluster %s failed - check username and password", c)
-				}
-				log.Log(ctx, LevelNotice, "Session-based authentication to cluster failed, attempting to re-authenticate", slog.String("cluster", c.String()))
-				if err = c.Authenticate(ctx); err != nil {
-					return nil, err
-				}
-				req, err = c.newGetRequest(ctx, u.String())
-				if err != nil {
-					return nil, err
-				}
-				continue
+	var reauth func(context.Context, uint64) error
+	if c.AuthType == authtypeSession {
+		reauth = c.reauthenticate
+		if gen, expired := c.sessionExpired(); expired {
+			log.Info("re-authenticating to cluster based on timer", slog.String("cluster", c.String()))
+			if err := c.reauthenticate(ctx, gen); err != nil {
+				return err
 			}
-			return nil, fmt.Errorf("cluster %s returned unexpected HTTP response: %v", c, resp.Status)
-		}
-		// assert err != nil
-		// TODO - consider adding more retryable cases e.g. temporary DNS hiccup
-		if !isConnectionRefused(err) {
-			return nil, err
-		}
-		log.Error("Connection refused, retrying", slog.String("cluster", c.Hostname), slog.Int("retry_in_seconds", retrySecs))
-		select {
-		case <-time.After(time.Duration(retrySecs) * time.Second):
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
-		retrySecs *= 2
-		if retrySecs > maxTimeoutSecs {
-			retrySecs = maxTimeoutSecs
 		}
 	}
+
+	resp, err := c.doWithRetry(ctx, endpoint, func() (*http.Request, error) {
+		return c.newGetRequest(ctx, endpoint)
+	}, reauth)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close() //nolint:errcheck
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cluster %s returned unexpected HTTP response: %v", c, resp.Status)
+		apiErr := newAPIError(c.name(), endpoint, resp)
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("basic authentication for cluster %s failed - check username and password: %w", c, apiErr)
+		}
+		return apiErr
 	}
-	body, err := io.ReadAll(resp.Body)
-	return body, err
+	defer resp.Body.Close() //nolint:errcheck
+	return fn(resp.Body)
+}
+
+// url returns the URL of the given API path on the current endpoint
+func (c *Cluster) url(path string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.baseURL + path
+}
+
+// newGetRequest returns a pointer to an http.Request for the given API path
+// initialized with the appropriate headers including authentication
+func (c *Cluster) newGetRequest(ctx context.Context, path string) (*http.Request, error) {
+	return c.newRequest(ctx, http.MethodGet, path)
 }
 
-// newGetRequest returns a pointer to an http.Request initialized with the
-// appropriate headers including authentication
-func (c *Cluster) newGetRequest(ctx context.Context, url string) (*http.Request, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// newRequest returns a pointer to an http.Request for the given method and
+// API path initialized with the appropriate headers including authentication
+func (c *Cluster) newRequest(ctx context.Context, method string, path string) (*http.Request, error) {
+	c.mu.Lock()
+	baseURL, csrfToken := c.baseURL, c.csrfToken
+	c.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -511,10 +1122,10 @@ func (c *Cluster) newGetRequest(ctx context.Context, url string) (*http.Request,
 	if c.AuthType == authtypeBasic {
 		req.SetBasicAuth(c.Username, c.Password)
 	}
-	if c.csrfToken != "" {
+	if csrfToken != "" {
 		// Must be newer session-based auth with CSRF protection
-		req.Header.Set("X-CSRF-Token", c.csrfToken)
-		req.Header.Set("Referer", c.baseURL)
+		req.Header.Set("X-CSRF-Token", csrfToken)
+		req.Header.Set("Referer", baseURL)
 	}
 	return req, nil
 }
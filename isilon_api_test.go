@@ -1,8 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestParsePPStatResult(t *testing.T) {
@@ -99,3 +113,785 @@ func TestParsePPStatResult(t *testing.T) {
 		}
 	})
 }
+
+func TestClusterConnect(t *testing.T) {
+	for _, authType := range []string{authtypeSession, authtypeBasic} {
+		t.Run(authType, func(t *testing.T) {
+			f := newFakePAPI(t)
+			c := f.cluster(authType)
+			if err := c.Connect(context.Background()); err != nil {
+				t.Fatalf("Connect failed: %v", err)
+			}
+			if c.ClusterName != "fakecluster" {
+				t.Errorf("ClusterName = %q, want %q", c.ClusterName, "fakecluster")
+			}
+			if c.OSVersion != "9.11.0.0" {
+				t.Errorf("OSVersion = %q, want %q", c.OSVersion, "9.11.0.0")
+			}
+			if !slices.Equal(c.Nodes, []int{1, 2, 3}) {
+				t.Errorf("Nodes = %v, want [1 2 3]", c.Nodes)
+			}
+			wantLogins := 0
+			if authType == authtypeSession {
+				wantLogins = 1
+				if c.csrfToken == "" {
+					t.Error("expected CSRF token to be set for session auth")
+				}
+			}
+			if got := f.hitCount(http.MethodPost, sessionPath); got != wantLogins {
+				t.Errorf("session logins = %d, want %d", got, wantLogins)
+			}
+		})
+	}
+}
+
+func TestClusterConnectPreserveCase(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.PreserveCase = true
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if c.ClusterName != "FakeCluster" {
+		t.Errorf("ClusterName = %q, want %q", c.ClusterName, "FakeCluster")
+	}
+}
+
+func TestClusterConnectBadCredentials(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.Password = "wrong"
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("expected Connect to fail with bad credentials")
+	}
+}
+
+func TestClusterConnectRefused(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.retry.maxRetries = 1
+	f.srv.Close()
+	err := c.Connect(context.Background())
+	if err == nil {
+		t.Fatal("expected Connect to fail against a closed server")
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected connection refused error, got %v", err)
+	}
+}
+
+func TestGetDataSetInfo(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	di, err := c.GetDataSetInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetDataSetInfo failed: %v", err)
+	}
+	if len(di.Datasets) != 2 {
+		t.Fatalf("got %d datasets, want 2", len(di.Datasets))
+	}
+	if di.Datasets[1].Name != "nfs_users" || di.Datasets[1].StatKey != "cluster.performance.dataset.1" {
+		t.Errorf("unexpected dataset entry %+v", di.Datasets[1])
+	}
+
+	t.Run("dataset definitions change", func(t *testing.T) {
+		f.setJSON(dsPath, DsInfo{
+			Datasets: []DsInfoEntry{
+				di.Datasets[0],
+				{ID: 2, Name: "smb_shares", CreationTime: 1700000200, Metrics: []string{"share_name"}},
+			},
+			Total: 2,
+		})
+		di, err := c.GetDataSetInfo(ctx)
+		if err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if len(di.Datasets) != 2 || di.Datasets[1].Name != "smb_shares" {
+			t.Errorf("dataset change not picked up: %+v", di.Datasets)
+		}
+	})
+}
+
+// streamAll returns every workload of a dataset read with StreamPPStats
+func streamAll(ctx context.Context, c *Cluster, dsName string) ([]PPStatResult, error) {
+	var results []PPStatResult
+	_, err := c.StreamPPStats(ctx, dsName, func(batch []PPStatResult) error {
+		results = append(results, batch...)
+		return nil
+	})
+	return results, err
+}
+
+func TestStreamPPStats(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	results, err := streamAll(ctx, c, "nfs_users")
+	if err != nil {
+		t.Fatalf("StreamPPStats failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if results[0].Username == nil || *results[0].Username != "alice" {
+		t.Errorf("Username = %v, want alice", results[0].Username)
+	}
+	if results[1].UserID == nil || *results[1].UserID != 2001 {
+		t.Errorf("UserID = %v, want 2001", results[1].UserID)
+	}
+	if results[2].WorkloadType == nil || *results[2].WorkloadType != wAdditional {
+		t.Errorf("WorkloadType = %v, want %s", results[2].WorkloadType, wAdditional)
+	}
+
+	t.Run("unexpected HTTP status", func(t *testing.T) {
+		f.inject(fakeFault{Path: ppWorkloadPath, Count: 1, Status: http.StatusInternalServerError})
+		if _, err := streamAll(ctx, c, "nfs_users"); err == nil {
+			t.Error("expected error for HTTP 500 response")
+		}
+	})
+
+	t.Run("default query", func(t *testing.T) {
+		if _, err := streamAll(ctx, c, "System"); err != nil {
+			t.Fatalf("StreamPPStats failed: %v", err)
+		}
+		q := f.lastQuery(ppWorkloadPath)
+		want := url.Values{"degraded": {"true"}, "nodes": {"all"}, "dataset": {"System"}}
+		if q.Encode() != want.Encode() {
+			t.Errorf("query = %s, want %s", q.Encode(), want.Encode())
+		}
+	})
+
+	t.Run("dataset params", func(t *testing.T) {
+		c.datasetParams = map[string]url.Values{
+			"nfs_users": {"totalby": {"zone_name"}, "protocols": {"nfs3,nfs4"}, "nodes": {"1,2"}},
+		}
+		defer func() { c.datasetParams = nil }()
+		if _, err := streamAll(ctx, c, "nfs_users"); err != nil {
+			t.Fatalf("StreamPPStats failed: %v", err)
+		}
+		q := f.lastQuery(ppWorkloadPath)
+		want := url.Values{"degraded": {"true"}, "nodes": {"1,2"}, "dataset": {"nfs_users"},
+			"totalby": {"zone_name"}, "protocols": {"nfs3,nfs4"}}
+		if q.Encode() != want.Encode() {
+			t.Errorf("query = %s, want %s", q.Encode(), want.Encode())
+		}
+		// other datasets are unaffected
+		if _, err := streamAll(ctx, c, "System"); err != nil {
+			t.Fatalf("StreamPPStats failed: %v", err)
+		}
+		if q := f.lastQuery(ppWorkloadPath); q.Has("totalby") {
+			t.Errorf("query for System includes totalby: %s", q.Encode())
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		before := f.gzipCount()
+		results, err := streamAll(ctx, c, "nfs_users")
+		if err != nil {
+			t.Fatalf("StreamPPStats failed: %v", err)
+		}
+		if len(results) != 3 {
+			t.Errorf("got %d results, want 3", len(results))
+		}
+		if got := f.lastHeader(ppWorkloadPath).Get("Accept-Encoding"); got != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", got)
+		}
+		if f.gzipCount() == before {
+			t.Error("workload response was not gzip-encoded")
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var batches int
+		n, err := c.StreamPPStats(ctx, "nfs_users", func(batch []PPStatResult) error {
+			batches++
+			return nil
+		})
+		if err != nil || n != 3 || batches != 1 {
+			t.Errorf("StreamPPStats = %d, %v with %d batches, want 3, nil with 1 batch", n, err, batches)
+		}
+		sinkErr := errors.New("sink failed")
+		if _, err := c.StreamPPStats(ctx, "nfs_users", func([]PPStatResult) error { return sinkErr }); !errors.Is(err, sinkErr) {
+			t.Errorf("StreamPPStats error = %v, want %v", err, sinkErr)
+		}
+	})
+}
+
+func TestDecodePPStats(t *testing.T) {
+	var workloads []string
+	for i := range 5 {
+		workloads = append(workloads, fmt.Sprintf(`{"node":%d,"ops":%d,"time":1700000000}`, i+1, i))
+	}
+	input := `{"total":5,"workload":[` + strings.Join(workloads, ",") + `],"resume":null}`
+	var sizes []int
+	var nodes []int
+	n, err := decodePPStats(strings.NewReader(input), 2, func(batch []PPStatResult) error {
+		sizes = append(sizes, len(batch))
+		for _, w := range batch {
+			nodes = append(nodes, w.Node)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodePPStats failed: %v", err)
+	}
+	if n != 5 || !slices.Equal(sizes, []int{2, 2, 1}) || !slices.Equal(nodes, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("decoded %d workloads in batches %v, nodes %v", n, sizes, nodes)
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		calls := 0
+		n, err := decodePPStats(strings.NewReader(`{"workload":[]}`), 2, func(batch []PPStatResult) error {
+			calls++
+			return nil
+		})
+		if err != nil || n != 0 || calls != 1 {
+			t.Errorf("decodePPStats = %d, %v with %d calls, want 0, nil with 1 call", n, err, calls)
+		}
+	})
+
+	t.Run("callback error stops decoding", func(t *testing.T) {
+		stop := errors.New("stop")
+		calls := 0
+		_, err := decodePPStats(strings.NewReader(input), 2, func([]PPStatResult) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("decodePPStats error = %v after %d calls, want %v after 1", err, calls, stop)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := decodePPStats(strings.NewReader(input[:len(input)/2]), 2, func([]PPStatResult) error { return nil })
+		if err == nil {
+			t.Error("expected error for truncated response")
+		}
+	})
+}
+
+func TestGetPPStatsByNode(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.nodeConcurrency = 2
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	upNodes := func(nodes []NodeStatus) []int {
+		var up []int
+		for _, n := range nodes {
+			if n.Up {
+				up = append(up, n.Node)
+			}
+		}
+		return up
+	}
+
+	results, nodes, err := c.GetPPStatsByNode(ctx, "nfs_users")
+	if err != nil {
+		t.Fatalf("GetPPStatsByNode failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Errorf("got %d results, want 3", len(results))
+	}
+	if got := upNodes(nodes); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("up nodes = %v, want [1 2 3]", got)
+	}
+	if q := f.lastQuery(ppWorkloadPath); q.Get("degraded") != "false" || q.Get("nodes") == "all" {
+		t.Errorf("per-node query = %v, want a single node without degraded mode", q)
+	}
+
+	t.Run("node down", func(t *testing.T) {
+		f.inject(fakeFault{Path: ppWorkloadPath, Query: url.Values{"nodes": {"3"}}, Count: -1,
+			Status: http.StatusInternalServerError})
+		defer f.clearFaults()
+		results, nodes, err := c.GetPPStatsByNode(ctx, "nfs_users")
+		if err != nil {
+			t.Fatalf("GetPPStatsByNode failed: %v", err)
+		}
+		if len(results) != 2 {
+			t.Errorf("got %d results, want 2", len(results))
+		}
+		for _, r := range results {
+			if r.Node == 3 {
+				t.Errorf("unexpected result from node 3: %+v", r)
+			}
+		}
+		if got := upNodes(nodes); !slices.Equal(got, []int{1, 2}) {
+			t.Errorf("up nodes = %v, want [1 2]", got)
+		}
+	})
+
+	t.Run("all nodes down", func(t *testing.T) {
+		f.inject(fakeFault{Path: ppWorkloadPath, Count: -1, Status: http.StatusInternalServerError})
+		defer f.clearFaults()
+		_, nodes, err := c.GetPPStatsByNode(ctx, "nfs_users")
+		if err == nil {
+			t.Fatal("expected error when no node answers")
+		}
+		if len(nodes) != 3 || len(upNodes(nodes)) != 0 {
+			t.Errorf("node status = %+v, want all 3 nodes down", nodes)
+		}
+	})
+
+	t.Run("concurrent reauthentication", func(t *testing.T) {
+		before := f.hitCount(http.MethodPost, sessionPath)
+		f.expireSessions()
+		if _, _, err := c.GetPPStatsByNode(ctx, "nfs_users"); err != nil {
+			t.Fatalf("GetPPStatsByNode failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodPost, sessionPath) - before; got != 1 {
+			t.Errorf("session logins = %d, want 1", got)
+		}
+	})
+}
+
+func TestGetExports(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	exports, err := c.GetExports(ctx, "")
+	if err != nil {
+		t.Fatalf("GetExports failed: %v", err)
+	}
+	if len(exports) != 2 {
+		t.Fatalf("got %d exports, want 2 (both pages)", len(exports))
+	}
+	if exports[1].ID != 2 || len(exports[1].Paths) != 2 || exports[1].Paths[0] != "/ifs/data/scratch" {
+		t.Errorf("unexpected second export %+v", exports[1])
+	}
+	if got := f.hitCount(http.MethodGet, exportPath); got != 2 {
+		t.Errorf("export list requests = %d, want 2", got)
+	}
+}
+
+func TestListAllPagination(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	page := func(id int, resume any) map[string]any {
+		return map[string]any{
+			"datasets": []map[string]any{{"id": id, "name": fmt.Sprintf("ds%d", id)}},
+			"resume":   resume,
+			"total":    3,
+		}
+	}
+	f.setJSON(dsPath, page(0, "p2"))
+	f.setJSON(dsPath+"?resume=p2", page(1, "p3"))
+	f.setJSON(dsPath+"?resume=p3", page(2, nil))
+	di, err := c.GetDataSetInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetDataSetInfo failed: %v", err)
+	}
+	if len(di.Datasets) != 3 || di.Total != 3 {
+		t.Fatalf("got %d datasets (total %d), want 3", len(di.Datasets), di.Total)
+	}
+	for i, ds := range di.Datasets {
+		if ds.ID != i {
+			t.Errorf("dataset %d has id %d", i, ds.ID)
+		}
+	}
+
+	t.Run("repeated resume token", func(t *testing.T) {
+		f.setJSON(dsPath+"?resume=p3", page(2, "p2"))
+		if _, err := c.GetDataSetInfo(ctx); err == nil {
+			t.Error("expected error for a resume token loop")
+		}
+	})
+
+	t.Run("failed page", func(t *testing.T) {
+		f.setJSON(dsPath+"?resume=p3", page(2, nil))
+		f.inject(fakeFault{Path: dsPath, Count: 2, Status: http.StatusForbidden})
+		if _, err := c.GetDataSetInfo(ctx); err == nil {
+			t.Error("expected error when a page cannot be read")
+		}
+	})
+}
+
+func TestReauthentication(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("session rejected by cluster", func(t *testing.T) {
+		f := newFakePAPI(t)
+		c := f.cluster(authtypeSession)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		f.expireSessions()
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed after session expiry: %v", err)
+		}
+		if got := f.hitCount(http.MethodPost, sessionPath); got != 2 {
+			t.Errorf("session logins = %d, want 2", got)
+		}
+	})
+
+	t.Run("reauth timer expired", func(t *testing.T) {
+		f := newFakePAPI(t)
+		c := f.cluster(authtypeSession)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		c.reauthTime = time.Now().Add(-time.Second)
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodPost, sessionPath); got != 2 {
+			t.Errorf("session logins = %d, want 2", got)
+		}
+		if f.hitCount(http.MethodGet, dsPath) != 1 {
+			t.Errorf("expected a single dataset request, got %d", f.hitCount(http.MethodGet, dsPath))
+		}
+	})
+
+	t.Run("short session timeout", func(t *testing.T) {
+		f := newFakePAPI(t)
+		f.SessionTimeout = 30
+		c := f.cluster(authtypeSession)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if c.reauthTime.After(time.Now().Add(31 * time.Second)) {
+			t.Errorf("reauth time %v does not honour timeout_absolute", c.reauthTime)
+		}
+	})
+
+	t.Run("basic auth rejected", func(t *testing.T) {
+		f := newFakePAPI(t)
+		c := f.cluster(authtypeBasic)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		c.Password = "changed"
+		if _, err := c.GetDataSetInfo(ctx); err == nil {
+			t.Error("expected error for rejected basic auth")
+		}
+	})
+}
+
+func TestParsePPStatResultErrors(t *testing.T) {
+	input := []byte(`{"errors":[{"code":"AEC_NOT_FOUND","message":"Dataset 'bogus' not found"}]}`)
+	_, err := parsePPStatResult(input)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *APIError, got %v", err)
+	}
+	if apiErr.Code != "AEC_NOT_FOUND" || apiErr.Message != "Dataset 'bogus' not found" {
+		t.Errorf("unexpected decoded error %+v", apiErr)
+	}
+	if !apiErr.Permanent() {
+		t.Error("AEC_NOT_FOUND should be a permanent error")
+	}
+}
+
+func TestAPIErrorPermanent(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   bool
+	}{
+		{http.StatusForbidden, "AEC_FORBIDDEN", true},
+		{http.StatusNotFound, "", true},
+		{http.StatusBadRequest, "AEC_BAD_REQUEST", true},
+		{http.StatusInternalServerError, "", false},
+		{http.StatusServiceUnavailable, "AEC_UNAVAILABLE", false},
+		{http.StatusInternalServerError, "AEC_SYSTEM_INTERNAL_ERROR", false},
+		{http.StatusTooManyRequests, "", false},
+	}
+	for _, tt := range tests {
+		e := &APIError{StatusCode: tt.status, Code: tt.code}
+		if got := e.Permanent(); got != tt.want {
+			t.Errorf("Permanent() for %d/%q = %v, want %v", tt.status, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestRestGetAPIError(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	t.Run("PAPI errors envelope", func(t *testing.T) {
+		f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden,
+			Body: `{"errors":[{"code":"AEC_FORBIDDEN","field":"dataset","message":"Privilege check failed"}]}`})
+		_, err := c.GetDataSetInfo(ctx)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError, got %v", err)
+		}
+		if apiErr.StatusCode != http.StatusForbidden || apiErr.Code != "AEC_FORBIDDEN" ||
+			apiErr.Field != "dataset" || apiErr.Message != "Privilege check failed" {
+			t.Errorf("unexpected decoded error %+v", apiErr)
+		}
+		if apiErr.Endpoint != dsPath {
+			t.Errorf("Endpoint = %q, want %q", apiErr.Endpoint, dsPath)
+		}
+		if !strings.Contains(err.Error(), "Privilege check failed") {
+			t.Errorf("error string %q does not include the cluster message", err)
+		}
+	})
+
+	t.Run("non-PAPI body", func(t *testing.T) {
+		f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusInternalServerError, Body: "upstream unavailable"})
+		_, err := c.GetDataSetInfo(ctx)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError, got %v", err)
+		}
+		if apiErr.Message != "upstream unavailable" || apiErr.Permanent() {
+			t.Errorf("unexpected decoded error %+v", apiErr)
+		}
+	})
+
+	t.Run("workload errors envelope", func(t *testing.T) {
+		f.setWorkload("nfs_users", map[string]any{
+			"errors": []map[string]string{{"code": "AEC_NOT_FOUND", "message": "Dataset not found"}},
+		})
+		_, err := streamAll(ctx, c, "nfs_users")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError, got %v", err)
+		}
+		if apiErr.Cluster != "fakecluster" || !apiErr.Permanent() {
+			t.Errorf("unexpected decoded error %+v", apiErr)
+		}
+	})
+}
+
+func TestEndpointFailover(t *testing.T) {
+	ctx := context.Background()
+	newPair := func(t *testing.T) (*fakePAPI, *fakePAPI, *Cluster) {
+		f1 := newFakePAPI(t)
+		f2 := newFakePAPI(t)
+		c := f1.cluster(authtypeSession)
+		c.Hostname = f1.srv.Listener.Addr().String()
+		c.FailoverHosts = []string{f2.srv.Listener.Addr().String()}
+		return f1, f2, c
+	}
+
+	t.Run("first endpoint down at connect", func(t *testing.T) {
+		f1, f2, c := newPair(t)
+		f1.srv.Close()
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if c.endpoint() != f2.srv.Listener.Addr().String() {
+			t.Errorf("endpoint = %s, want second endpoint", c.endpoint())
+		}
+		if got := f2.hitCount(http.MethodPost, sessionPath); got != 1 {
+			t.Errorf("second endpoint logins = %d, want 1", got)
+		}
+	})
+
+	t.Run("server error switches endpoint and re-authenticates", func(t *testing.T) {
+		f1, f2, c := newPair(t)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		f1.inject(fakeFault{Path: dsPath, Count: -1, Status: http.StatusServiceUnavailable})
+		di, err := c.GetDataSetInfo(ctx)
+		if err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if len(di.Datasets) != 2 {
+			t.Errorf("got %d datasets, want 2", len(di.Datasets))
+		}
+		if got := f2.hitCount(http.MethodPost, sessionPath); got != 1 {
+			t.Errorf("second endpoint logins = %d, want 1", got)
+		}
+		if got := f2.hitCount(http.MethodGet, dsPath); got != 1 {
+			t.Errorf("second endpoint dataset requests = %d, want 1", got)
+		}
+	})
+
+	t.Run("endpoint goes away mid-run", func(t *testing.T) {
+		f1, f2, c := newPair(t)
+		c.AuthType = authtypeBasic
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		f1.srv.Close()
+		if _, err := streamAll(ctx, c, "System"); err != nil {
+			t.Fatalf("StreamPPStats failed: %v", err)
+		}
+		if got := f2.hitCount(http.MethodGet, ppWorkloadPath); got != 1 {
+			t.Errorf("second endpoint workload requests = %d, want 1", got)
+		}
+	})
+
+	t.Run("client errors do not fail over", func(t *testing.T) {
+		f1, f2, c := newPair(t)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		f1.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden})
+		if _, err := c.GetDataSetInfo(ctx); err == nil {
+			t.Fatal("expected error for HTTP 403")
+		}
+		if f2.hitCount(http.MethodGet, dsPath) != 0 {
+			t.Error("HTTP 403 should not trigger failover")
+		}
+	})
+}
+
+func TestEndpointAddr(t *testing.T) {
+	c := &Cluster{Port: 8080}
+	tests := map[string]string{
+		"node1.example.com":      "node1.example.com:8080",
+		"node1.example.com:9443": "node1.example.com:9443",
+		"10.0.0.1":               "10.0.0.1:8080",
+		"fe80::1":                "[fe80::1]:8080",
+		"[fe80::1]:9443":         "[fe80::1]:9443",
+	}
+	for in, want := range tests {
+		if got := c.endpointAddr(in); got != want {
+			t.Errorf("endpointAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	c.RequestTimeout = 200 * time.Millisecond
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	f.inject(fakeFault{Path: dsPath, Count: -1, Delay: 5 * time.Second})
+	start := time.Now()
+	if _, err := c.GetDataSetInfo(ctx); err == nil {
+		t.Fatal("expected hung request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, request timeout not applied", elapsed)
+	}
+}
+
+func TestClusterTLS(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	cert := f.srv.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatalf("unable to write CA file: %v", err)
+	}
+	invalidCAFile := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalidCAFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("unable to write CA file: %v", err)
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var colonFingerprint []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colonFingerprint = append(colonFingerprint, fingerprint[i:i+2])
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(c *Cluster)
+		wantErr bool
+	}{
+		{"verify without CA fails", func(c *Cluster) { c.VerifySSL = true }, true},
+		{"verify with CA file", func(c *Cluster) { c.VerifySSL = true; c.CAFile = caFile }, false},
+		{"server name override", func(c *Cluster) {
+			c.VerifySSL = true
+			c.CAFile = caFile
+			c.ServerName = "example.com"
+		}, false},
+		{"wrong server name", func(c *Cluster) {
+			c.VerifySSL = true
+			c.CAFile = caFile
+			c.ServerName = "wrong.example.org"
+		}, true},
+		{"pinned self-signed certificate", func(c *Cluster) {
+			c.Fingerprints = []string{strings.Join(colonFingerprint, ":")}
+		}, false},
+		{"pin with verification", func(c *Cluster) {
+			c.VerifySSL = true
+			c.CAFile = caFile
+			c.Fingerprints = []string{"00" + fingerprint[2:], fingerprint}
+		}, false},
+		{"pin mismatch", func(c *Cluster) {
+			c.Fingerprints = []string{strings.Repeat("ab", sha256.Size)}
+		}, true},
+		{"invalid pin", func(c *Cluster) { c.Fingerprints = []string{"abcd"} }, true},
+		{"client cert without key", func(c *Cluster) { c.ClientCert = caFile }, true},
+		{"missing CA file", func(c *Cluster) { c.VerifySSL = true; c.CAFile = caFile + ".missing" }, true},
+		{"missing CA file without verify", func(c *Cluster) { c.CAFile = caFile + ".missing" }, false},
+		{"invalid CA file without verify", func(c *Cluster) { c.CAFile = invalidCAFile }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := f.cluster(authtypeSession)
+			c.retry.maxRetries = 1
+			tt.setup(c)
+			err := c.Connect(ctx)
+			if tt.wantErr && err == nil {
+				t.Error("expected Connect to fail")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Connect failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestClusterLogout(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if got := f.sessionCount(); got != 1 {
+		t.Fatalf("sessions = %d, want 1", got)
+	}
+	// logout must still work once the collector has been cancelled
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Logout(cctx); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if got := f.sessionCount(); got != 0 {
+		t.Errorf("sessions after logout = %d, want 0", got)
+	}
+	if got := f.hitCount(http.MethodDelete, sessionPath); got != 1 {
+		t.Errorf("logout requests = %d, want 1", got)
+	}
+	// a second logout is a no-op
+	if err := c.Logout(ctx); err != nil {
+		t.Errorf("second Logout failed: %v", err)
+	}
+	if got := f.hitCount(http.MethodDelete, sessionPath); got != 1 {
+		t.Errorf("logout requests = %d, want 1", got)
+	}
+
+	b := f.cluster(authtypeBasic)
+	if err := b.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := b.Logout(ctx); err != nil {
+		t.Errorf("Logout for basic auth failed: %v", err)
+	}
+	if got := f.hitCount(http.MethodDelete, sessionPath); got != 1 {
+		t.Errorf("basic auth Logout sent a request")
+	}
+}
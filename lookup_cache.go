@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Default lifetime of the NFS export, SMB share and access zone caches, in seconds
+const defaultLookupCacheTTL = 600
+
+// If a refresh of a lookup cache fails, or a key is not found, we wait at
+// least this long before loading the cache again
+const lookupRetryIntvl = time.Minute
+
+// lookupFailed is used as the tag value when a lookup cannot be resolved
+const lookupFailed = "unknown (lookup failed)"
+
+// lookupCache is a per-cluster cache of object definitions (e.g. NFS exports)
+// that are loaded from the cluster in bulk. The whole cache is reloaded when
+// it is older than its TTL, or when a key is not found, so new and changed
+// definitions are picked up without a request per key. The lock is not held
+// while the cache is loaded, so lookups of keys already in the cache carry on
+// with the existing contents meanwhile.
+type lookupCache[K comparable, V any] struct {
+	mu        sync.Mutex
+	what      string // description of the cached objects for logging
+	ttl       time.Duration
+	load      func(ctx context.Context, c *Cluster) (map[K]V, error)
+	items     map[K]V
+	refreshed time.Time     // last successful refresh
+	attempted time.Time     // last refresh attempt
+	loading   chan struct{} // closed when the refresh in progress ends, nil if none
+}
+
+func newLookupCache[K comparable, V any](what string, ttl time.Duration,
+	load func(ctx context.Context, c *Cluster) (map[K]V, error)) *lookupCache[K, V] {
+	return &lookupCache[K, V]{what: what, ttl: ttl, load: load, items: make(map[K]V)}
+}
+
+// lookup returns the value for key, reloading the cache first if it has
+// expired or does not contain the key. If the reload fails, the existing
+// contents of the cache continue to be used. If another lookup is already
+// reloading the cache, the existing value is returned, or if there is none,
+// the reload is waited for.
+func (lc *lookupCache[K, V]) lookup(ctx context.Context, c *Cluster, key K) (V, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	v, found := lc.items[key]
+	now := time.Now()
+	switch {
+	case found && now.Sub(lc.refreshed) < lc.ttl:
+	case found && lc.loading != nil:
+		// use the existing value while another lookup reloads the cache
+	case lc.loading != nil:
+		done := lc.loading
+		lc.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		lc.mu.Lock()
+		v, found = lc.items[key]
+	case now.Sub(lc.attempted) >= lookupRetryIntvl:
+		lc.refresh(ctx, c)
+		v, found = lc.items[key]
+	}
+	return v, found
+}
+
+// preload loads the cache if it has never been loaded and is not being loaded
+func (lc *lookupCache[K, V]) preload(ctx context.Context, c *Cluster) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.refreshed.IsZero() && lc.loading == nil {
+		lc.refresh(ctx, c)
+	}
+}
+
+// refresh reloads the cache from the cluster. It must be called with the lock
+// held, and releases it while the cache is loaded.
+func (lc *lookupCache[K, V]) refresh(ctx context.Context, c *Cluster) {
+	done := make(chan struct{})
+	start := time.Now()
+	lc.loading = done
+	lc.attempted = start
+	lc.mu.Unlock()
+	items, err := lc.load(ctx, c)
+	lc.mu.Lock()
+	lc.loading = nil
+	close(done)
+	if err != nil {
+		log.Error("failed to refresh lookup cache", slog.String("cluster", c.name()),
+			slog.String("cache", lc.what), slog.Any("error", err))
+		return
+	}
+	log.Debug("refreshed lookup cache", slog.String("cluster", c.name()),
+		slog.String("cache", lc.what), slog.Int("entries", len(items)))
+	lc.items = items
+	lc.refreshed = start
+}
+
+// preloadLookupCaches loads the cluster's NFS export, SMB share and access
+// zone caches up front, rather than when the first workload needs them
+func (c *Cluster) preloadLookupCaches(ctx context.Context) {
+	if c.exports != nil {
+		c.exports.preload(ctx, c)
+	}
+	if c.shares != nil {
+		c.shares.preload(ctx, c)
+	}
+	if c.zones != nil {
+		c.zones.preload(ctx, c)
+	}
+}
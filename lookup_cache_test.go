@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLookupCacheConcurrentRefresh(t *testing.T) {
+	ctx := context.Background()
+	c := &Cluster{ClusterName: "test"}
+	var loads atomic.Int32
+	release := make(chan struct{})
+	lc := newLookupCache("test objects", time.Hour, func(ctx context.Context, c *Cluster) (map[int]string, error) {
+		if loads.Add(1) > 1 {
+			<-release
+		}
+		return map[int]string{1: "one", 2: "two"}, nil
+	})
+	lc.preload(ctx, c)
+	if loads.Load() != 1 {
+		t.Fatalf("loads = %d after preload, want 1", loads.Load())
+	}
+	lc.preload(ctx, c)
+	if v, found := lc.lookup(ctx, c, 1); !found || v != "one" || loads.Load() != 1 {
+		t.Errorf("lookup = %q, %v after %d loads, want one from the preloaded cache", v, found, loads.Load())
+	}
+
+	// a lookup of a missing key reloads the cache; meanwhile, lookups of keys
+	// in the cache are not held up, and those of missing keys wait for it
+	lc.attempted = time.Time{}
+	missing := make(chan bool, 1)
+	go func() {
+		_, found := lc.lookup(ctx, c, 3)
+		missing <- found
+	}()
+	waitFor(t, 5*time.Second, func() bool { return loads.Load() == 2 })
+	waiting := make(chan bool, 1)
+	go func() {
+		_, found := lc.lookup(ctx, c, 4)
+		waiting <- found
+	}()
+	done := make(chan string, 1)
+	go func() {
+		v, _ := lc.lookup(ctx, c, 2)
+		done <- v
+	}()
+	select {
+	case v := <-done:
+		if v != "two" {
+			t.Errorf("lookup during reload = %q, want two", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup of a cached key waited for the reload")
+	}
+	select {
+	case <-waiting:
+		t.Fatal("lookup of a missing key did not wait for the reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if <-missing || <-waiting {
+		t.Error("unknown keys found")
+	}
+	if got := loads.Load(); got != 2 {
+		t.Errorf("loads = %d, want 2", got)
+	}
+}
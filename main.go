@@ -6,8 +6,13 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -17,9 +22,13 @@ import (
 const Version = "0.32"
 const userAgent = "goppstats/" + Version
 
-// PPSampleRate is the poll interval in seconds; PP stats are only updated once every thirty seconds.
+// PPSampleRate is the default poll interval in seconds; PP stats are only updated once every thirty seconds.
 const PPSampleRate = 30
 
+// sampleSettleTime is how long after a sample boundary we wait before polling,
+// to give the cluster time to publish the new sample
+const sampleSettleTime = 2 * time.Second
+
 const (
 	authtypeBasic   = "basic-auth"
 	authtypeSession = "session"
@@ -113,13 +122,16 @@ func main() {
 		log.Warn("Config file watching not available", slog.String("error", err.Error()))
 	}
 
+	// connected clusters kept across config reloads
+	pool := newSessionPool()
+
 outer:
 	for {
 		// Create a per-run context so collectors can be cancelled independently
 		// of the top-level context (e.g. on SIGHUP reload).
 		runCtx, cancelRun := context.WithCancel(ctx)
 
-		if conf.Global.Processor == promPluginName && conf.PromSD.Enabled {
+		if slices.Contains(conf.backends(), promPluginName) && conf.PromSD.Enabled {
 			if err := startPromSdListener(runCtx, conf); err != nil {
 				log.Error("Failed to start Prometheus SD listener", slog.Any("error", err))
 			}
@@ -136,7 +148,7 @@ outer:
 			go func(ci int, cl clusterConf) {
 				log.Info("spawning collection loop for cluster", slog.String("cluster", cl.Hostname))
 				defer wg.Done()
-				statsloop(runCtx, &conf, ci)
+				superviseCluster(runCtx, &conf, ci, pool)
 				log.Info("collection loop for cluster ended", slog.String("cluster", cl.Hostname))
 			}(ci, cl)
 		}
@@ -165,6 +177,7 @@ outer:
 				setupLogging(conf.Logging, *logLevel, *logFileName)
 				log.Log(ctx, LevelNotice, "Config reloaded successfully")
 			}
+			pool.prune(ctx, &conf)
 			continue
 		case <-done:
 			cancelRun()
@@ -175,17 +188,57 @@ outer:
 			break outer
 		}
 	}
+	pool.closeAll(ctx)
 	log.Log(ctx, LevelNotice, "All collectors complete - exiting")
 }
 
-func statsloop(ctx context.Context, config *tomlConfig, ci int) {
-	var err error
-	var password string
-	var ss DBWriter // ss = stats sink
-
+// statsloop connects to a cluster and collects its stats until the context
+// is cancelled, when it returns nil, or collection fails. Errors that
+// restarting cannot fix wrap errCollectorConfig. The stats sink is kept in *ss
+// across runs: the first run to connect creates it, initialized with sinkCtx,
+// and later runs re-initialize it for their connection.
+func statsloop(ctx, sinkCtx context.Context, config *tomlConfig, ci int, pool *sessionPool, ss *DBWriter) error {
 	cc := config.Clusters[ci]
 	gc := config.Global
 
+	// Connect to the cluster
+	c, err := newCluster(cc, gc)
+	if err != nil {
+		return fmt.Errorf("%w: invalid cluster configuration: %w", errCollectorConfig, err)
+	}
+	if !pool.take(ctx, c) {
+		if err = c.Connect(ctx); err != nil {
+			logout(ctx, c)
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return fmt.Errorf("connection to cluster failed: %w", err)
+		}
+		log.Info("Connected to cluster", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
+	}
+	defer pool.release(ctx, c)
+
+	// Configure/initialize backend database writer
+	if *ss == nil {
+		w, err := makeStatsSink(c, config, ci)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errCollectorConfig, err)
+		}
+		if err = w.Init(sinkCtx, c, config, ci); err != nil {
+			return fmt.Errorf("unable to initialize back end: %w", err)
+		}
+		*ss = w
+	} else if err = (*ss).Init(sinkCtx, c, config, ci); err != nil {
+		return fmt.Errorf("unable to initialize back end: %w", err)
+	}
+
+	collectors.setState(cc.Hostname, collectorCollecting)
+	return collectStats(ctx, c, *ss, gc)
+}
+
+// newCluster returns an unconnected Cluster for the given cluster config,
+// applying global defaults for anything the cluster does not override
+func newCluster(cc clusterConf, gc globalConfig) (*Cluster, error) {
 	var preserveCase bool
 
 	if cc.PreserveCase == nil { // check for cluster overwrite setting of PreserveCase, default and to global setting
@@ -194,7 +247,6 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int) {
 		preserveCase = *cc.PreserveCase
 	}
 
-	// Connect to the cluster
 	authtype := cc.AuthType
 	if authtype == "" {
 		log.Info("No authentication type defined for cluster, defaulting",
@@ -210,64 +262,151 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int) {
 		authtype = defaultAuthType
 	}
 	if cc.Username == "" || cc.Password == "" {
-		log.Error("Username and password for cluster must not be null", slog.String("cluster", cc.Hostname))
-		return
+		return nil, fmt.Errorf("username and password for cluster must not be null")
 	}
-	password, err = secretFromEnv(cc.Password)
+	password, err := secretFromEnv(cc.Password)
 	if err != nil {
-		log.Error("Unable to retrieve password from environment for cluster",
-			slog.String("cluster", cc.Hostname),
-			slog.Any("error", err))
-		return
+		return nil, fmt.Errorf("unable to retrieve password from environment: %w", err)
 	}
-	c := &Cluster{
-		AuthInfo: AuthInfo{
-			Username: cc.Username,
-			Password: password,
-		},
-		AuthType:     authtype,
-		Hostname:     cc.Hostname,
-		Port:         8080,
-		VerifySSL:    cc.SSLCheck,
-		maxRetries:   gc.MaxRetries,
-		PreserveCase: preserveCase,
+	// readConfig will normally have populated these already
+	ac := cc.apiConnConfig
+	ac.applyDefaults(gc.apiConnConfig)
+	ac.applyDefaults(defaultAPIConnConfig())
+	if *ac.APIScheme == "http" {
+		log.Warn("Cluster API scheme is plain http, credentials will be sent unencrypted", slog.String("cluster", cc.Hostname))
 	}
-	if err = c.Connect(ctx); err != nil {
-		if !errors.Is(err, context.Canceled) {
-			log.Error("Connection to cluster failed", slog.String("cluster", c.Hostname), slog.Any("error", err))
+	datasetParams := make(map[string]url.Values)
+	for ds, params := range cc.DatasetParams {
+		q, err := datasetQuery(params)
+		if err != nil {
+			return nil, fmt.Errorf("dataset_params.%s: %w", ds, err)
 		}
-		return
+		datasetParams[ds] = q
 	}
-	log.Info("Connected to cluster", slog.String("cluster", c.ClusterName), slog.String("version", c.OSVersion))
-
-	// Configure/initialize backend database writer
-	ss, err = getDBWriter(gc.Processor)
-	if err != nil {
-		log.Error("unsupported backend plugin", slog.Any("error", err))
-		return
+	var exports *exportCache
+	if gc.LookupExportIDs {
+		exports = newExportCache(time.Duration(gc.LookupCacheTTL) * time.Second)
+	}
+	var shares *shareCache
+	if gc.LookupShareNames {
+		shares = newShareCache(time.Duration(gc.LookupCacheTTL) * time.Second)
+	}
+	var zones *zoneCache
+	if gc.LookupZoneIDs {
+		zones = newZoneCache(time.Duration(gc.LookupCacheTTL) * time.Second)
+	}
+	perNode := gc.PerNodeCollection
+	if cc.PerNode != nil {
+		perNode = *cc.PerNode
+	}
+	pollInterval := gc.PollInterval
+	if cc.PollInterval != nil {
+		pollInterval = *cc.PollInterval
 	}
-	err = ss.Init(ctx, c, config, ci)
+	if pollInterval < gc.MinUpdateInvtl {
+		log.Warn("Poll interval for cluster is below the minimum update interval, using the minimum",
+			slog.String("cluster", cc.Hostname),
+			slog.Int("poll_interval", pollInterval),
+			slog.Int("min_update_interval", gc.MinUpdateInvtl))
+		pollInterval = gc.MinUpdateInvtl
+	}
+	include, exclude := gc.IncludeDatasets, gc.ExcludeDatasets
+	if cc.IncludeDatasets != nil {
+		include = cc.IncludeDatasets
+	}
+	if cc.ExcludeDatasets != nil {
+		exclude = cc.ExcludeDatasets
+	}
+	datasets, err := newDatasetFilter(include, exclude)
 	if err != nil {
-		log.Error("Unable to initialize plugin", slog.String("plugin", gc.Processor), slog.Any("error", err))
-		return
+		return nil, err
+	}
+	var identities *identityCache
+	if gc.LookupIdentities {
+		identities = newIdentityCache(gc.IdentityCacheSize, time.Duration(gc.IdentityCacheTTL)*time.Second)
 	}
+	return &Cluster{
+		AuthInfo: AuthInfo{
+			Username: cc.Username,
+			Password: password,
+		},
+		AuthType:            authtype,
+		Hostname:            cc.Hostname,
+		FailoverHosts:       cc.FailoverHosts,
+		Port:                *ac.APIPort,
+		Scheme:              *ac.APIScheme,
+		VerifySSL:           cc.SSLCheck,
+		CAFile:              cc.CAFile,
+		ClientCert:          cc.ClientCert,
+		ClientKey:           cc.ClientKey,
+		ServerName:          cc.ServerName,
+		Fingerprints:        cc.Fingerprints,
+		ConnectTimeout:      time.Duration(*ac.ConnectTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(*ac.TLSHandshakeTimeout) * time.Second,
+		RequestTimeout:      time.Duration(*ac.RequestTimeout) * time.Second,
+		MaxIdleConns:        *ac.MaxIdleConns,
+		MaxIdleConnsPerHost: *ac.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(*ac.IdleConnTimeout) * time.Second,
+		retry: retryPolicy{
+			maxRetries:   gc.MaxRetries,
+			initialDelay: time.Duration(gc.RetryInitialIntvl) * time.Second,
+			maxDelay:     time.Duration(gc.RetryMaxIntvl) * time.Second,
+		},
+		pollInterval:    time.Duration(pollInterval) * time.Second,
+		perNode:         perNode,
+		nodeConcurrency: gc.NodeConcurrency,
+		datasetParams:   datasetParams,
+		datasets:        datasets,
+		exports:         exports,
+		shares:          shares,
+		zones:           zones,
+		identities:      identities,
+		PreserveCase:    preserveCase,
+	}, nil
+}
 
+// collectStats loops collecting stats from the connected cluster and pushing
+// them to the stats sink until the context is cancelled, when it returns nil,
+// or an unrecoverable error occurs
+func collectStats(ctx context.Context, c *Cluster, ss DBWriter, gc globalConfig) error {
 	// loop collecting and pushing stats
 	log.Info("Starting stat collection loop for cluster", slog.String("cluster", c.ClusterName))
+	c.preloadLookupCaches(ctx)
+	states := make(map[string]*dsState)
+	interval := c.pollInterval
+	if interval <= 0 {
+		interval = PPSampleRate * time.Second
+	}
+	var lastSample int64 // time of the newest sample collected
 	for {
 		curTime := time.Now()
-		nextTime := curTime.Add(time.Second * PPSampleRate)
+		nextTime := curTime.Add(interval)
 
 		// Grab current dataset definitions
 		log.Info("Querying initial PP stat datasets for cluster", slog.String("cluster", c.ClusterName))
 		di, err := c.GetDataSetInfo(ctx)
 		if err != nil {
-			if !errors.Is(err, context.Canceled) {
-				log.Error("Unable to retrieve dataset information for cluster",
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && !apiErr.Permanent() {
+				log.Warn("Transient error retrieving dataset information for cluster, will retry next cycle",
 					slog.String("cluster", c.ClusterName),
 					slog.Any("error", err))
+				if !sleepUntil(ctx, nextTime) {
+					log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
+					return nil
+				}
+				continue
 			}
-			return
+			return fmt.Errorf("unable to retrieve dataset information: %w", err)
+		}
+		di, dropped := c.datasets.apply(di)
+		if len(dropped) > 0 {
+			log.Debug("Skipping datasets not selected for collection",
+				slog.String("cluster", c.ClusterName),
+				slog.Any("datasets", dropped))
 		}
 		log.Info("Got data set definitions", slog.Int("count", di.Total))
 		for i, entry := range di.Datasets {
@@ -277,98 +416,473 @@ func statsloop(ctx context.Context, config *tomlConfig, ci int) {
 				slog.String("statkey", entry.StatKey))
 		}
 		ss.UpdateDatasets(di)
+		stats := append(c.performanceSettingStats(), collectors.stats(c.Hostname)...)
+		if len(stats) > 0 {
+			if err := ss.WriteClusterStats(ctx, stats); err != nil {
+				log.Warn("Unable to write cluster stats to back end",
+					slog.String("cluster", c.ClusterName),
+					slog.Any("error", err))
+			}
+		}
 
 		// Collect one set of stats
 		log.Info("Cluster start collecting pp stats", slog.String("cluster", c.ClusterName))
-		var sr []PPStatResult
-		readFailCount := 0
-		const maxRetryTime = time.Second * 1280
-		retryTime := time.Second * 10
-		for _, ds := range di.Datasets {
-			dsName := ds.Name
-			log.Debug("Cluster start collecting data set",
-				slog.String("cluster", c.ClusterName),
-				slog.String("dataset", dsName))
-			for {
-				sr, err = c.GetPPStats(ctx, dsName)
-				if err == nil {
-					break
-				}
-				if errors.Is(err, context.Canceled) {
-					return
-				}
-				readFailCount++
-				log.Error("Failed to retrieve PP stats",
-					slog.String("dataset", dsName),
+		sampleTime, err := collectDatasets(ctx, c, ss, di.Datasets, gc, states)
+		if err != nil {
+			if errors.Is(err, errSinkWrite) {
+				return fmt.Errorf("ProcessorMaxRetries exceeded: %w", err)
+			}
+			return nil
+		}
+		if stats := duplicateSampleStats(states); len(stats) > 0 {
+			if err := ss.WriteClusterStats(ctx, stats); err != nil {
+				log.Warn("Unable to write duplicate sample counts to back end",
 					slog.String("cluster", c.ClusterName),
-					slog.Any("error", err),
-					slog.Int("retry", readFailCount),
-					slog.Duration("retry_in", retryTime))
-				select {
-				case <-time.After(retryTime):
-				case <-ctx.Done():
-					log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
-					return
-				}
-				if retryTime < maxRetryTime {
-					retryTime *= 2
-				}
+					slog.Any("error", err))
 			}
+		}
+		if sampleTime > 0 {
+			lastSample = sampleTime
+		}
+		if lastSample > 0 {
+			nextTime = nextPollTime(curTime, time.Now(), lastSample, interval)
+		}
 
-			log.Info("Got workload entries", slog.Int("count", len(sr)))
-			log.Info("Cluster start writing stats to back end", slog.String("cluster", c.ClusterName))
-			// write PP stats, now with retries
-			retryTime = time.Second * time.Duration(gc.ProcessorRetryIntvl)
-			for i := 1; i <= gc.ProcessorMaxRetries; i++ {
-				err = ss.WritePPStats(ctx, ds, sr)
-				if err == nil {
-					break
-				}
-				if errors.Is(err, context.Canceled) {
-					return
-				}
-				log.Error("write error, retrying",
-					slog.Any("error", err),
-					slog.Int("retry", i),
-					slog.Duration("retry_in", retryTime))
-				select {
-				case <-time.After(retryTime):
-				case <-ctx.Done():
-					log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
-					return
-				}
-				if retryTime < maxRetryTime {
-					retryTime *= 2
-				}
-			}
+		if !sleepUntil(ctx, nextTime) {
+			log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
+			return nil
+		}
+	}
+}
+
+// Limits on the delay before a failed dataset is collected again
+const (
+	dsInitialRetryTime = time.Second * 10
+	dsMaxRetryTime     = time.Second * 1280
+)
+
+// dsState is the collection state of a dataset, kept across cycles. Each
+// dataset backs off independently after a failure so that one failing
+// dataset does not delay the others.
+type dsState struct {
+	failures   int
+	retryTime  time.Duration // delay after the next failure
+	next       time.Time     // no collection attempt before this time
+	lastSample int64         // time of the newest sample written
+	duplicates int           // number of workloads skipped as already written
+}
+
+// failed records a failed collection attempt and returns the delay before the
+// next one
+func (st *dsState) failed(now time.Time) time.Duration {
+	st.failures++
+	if st.retryTime == 0 {
+		st.retryTime = dsInitialRetryTime
+	}
+	delay := st.retryTime
+	st.next = now.Add(delay)
+	if st.retryTime < dsMaxRetryTime {
+		st.retryTime *= 2
+	}
+	return delay
+}
+
+// succeeded resets the retry state after a successful collection
+func (st *dsState) succeeded() {
+	st.failures = 0
+	st.retryTime = 0
+	st.next = time.Time{}
+}
+
+// nextPollTime returns when to next poll the cluster, given the start time of
+// the current poll and the time of the newest sample seen. Polls are aligned
+// to the cluster's sample boundaries, shortly after a whole number of
+// intervals from sampleTime, rather than drifting by the time each collection
+// takes. The next poll is never less than interval after start, nor in the
+// past, and a skewed cluster clock can delay it by at most one interval.
+func nextPollTime(start time.Time, now time.Time, sampleTime int64, interval time.Duration) time.Time {
+	earliest := start.Add(interval)
+	if now.After(earliest) {
+		earliest = now
+	}
+	base := time.Unix(sampleTime, 0).Add(sampleSettleTime)
+	steps := earliest.Sub(base) / interval
+	next := base.Add(steps * interval)
+	if next.Before(earliest) {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// collectDatasets collects one set of stats for each dataset, running up to
+// dataset_concurrency collections at a time, and returns the time of the
+// newest sample collected, or 0 if there were none. A dataset whose last
+// collection failed is skipped until its backoff delay has passed; states
+// holds each dataset's state across cycles, keyed by dataset name. An error
+// is only returned if collection for the cluster must stop: on cancellation
+// or if stats could not be written to the back end.
+func collectDatasets(ctx context.Context, c *Cluster, ss DBWriter, datasets []DsInfoEntry, gc globalConfig,
+	states map[string]*dsState) (int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// forget the state of deleted datasets
+	current := make(map[string]bool, len(datasets))
+	for _, ds := range datasets {
+		current[ds.Name] = true
+	}
+	for name := range states {
+		if !current[name] {
+			delete(states, name)
+		}
+	}
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		sampleTime int64
+	)
+	sem := make(chan struct{}, max(gc.DatasetConcurrency, 1))
+	now := time.Now()
+	for _, ds := range datasets {
+		st := states[ds.Name]
+		if st == nil {
+			st = &dsState{}
+			states[ds.Name] = st
+		}
+		if now.Before(st.next) {
+			log.Debug("Skipping dataset until its retry time",
+				slog.String("cluster", c.ClusterName),
+				slog.String("dataset", ds.Name),
+				slog.Time("retry_at", st.next))
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t, err := collectDatasetOnce(ctx, c, ss, ds, gc, st)
 			if err != nil {
-				log.Error("ProcessorMaxRetries exceeded, failed to write stats to database", slog.Any("error", err))
+				cancel(err)
 				return
 			}
+			mu.Lock()
+			sampleTime = max(sampleTime, t)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
 		}
+		return 0, err
+	}
+	return sampleTime, nil
+}
 
-		curTime = time.Now()
-		if curTime.Before(nextTime) {
-			select {
-			case <-time.After(nextTime.Sub(curTime)):
-			case <-ctx.Done():
-				log.Log(ctx, LevelNotice, "shutting down stats collection", slog.String("cluster", c.ClusterName))
-				return
+// collectDatasetOnce makes one attempt to collect a dataset, updating its
+// state, and returns the time of the newest sample written. Failures to
+// query the cluster are logged and only returned on cancellation.
+func collectDatasetOnce(ctx context.Context, c *Cluster, ss DBWriter, ds DsInfoEntry, gc globalConfig, st *dsState) (int64, error) {
+	log.Debug("Cluster start collecting data set",
+		slog.String("cluster", c.ClusterName),
+		slog.String("dataset", ds.Name))
+	count, err := collectDataset(ctx, c, ss, ds, gc, st)
+	if err == nil {
+		st.succeeded()
+		log.Info("Wrote workload entries", slog.String("dataset", ds.Name), slog.Int("count", count))
+		return st.lastSample, nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, errSinkWrite) {
+		return 0, err
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Permanent() {
+		// no point retrying e.g. a privilege problem or a dataset deleted under us
+		log.Error("Cluster rejected PP stats query, skipping dataset for this collection cycle",
+			slog.String("dataset", ds.Name),
+			slog.String("cluster", c.ClusterName),
+			slog.Int("status", apiErr.StatusCode),
+			slog.String("code", apiErr.Code),
+			slog.String("message", apiErr.Message))
+		return 0, nil
+	}
+	retryIn := st.failed(time.Now())
+	log.Error("Failed to retrieve PP stats",
+		slog.String("dataset", ds.Name),
+		slog.String("cluster", c.ClusterName),
+		slog.Any("error", err),
+		slog.Int("retry", st.failures),
+		slog.Duration("retry_in", retryIn))
+	return 0, nil
+}
+
+// duplicateSampleStats returns the number of workloads skipped for each
+// dataset because they had already been written, as duplicate_samples stats
+func duplicateSampleStats(states map[string]*dsState) []ClusterStat {
+	now := time.Now().Unix()
+	stats := make([]ClusterStat, 0, len(states))
+	for name, st := range states {
+		stats = append(stats, ClusterStat{
+			Name:  "duplicate_samples",
+			Tags:  map[string]string{"dataset": name},
+			Value: float64(st.duplicates),
+			Time:  now,
+		})
+	}
+	return stats
+}
+
+// errSinkWrite is returned by collectDataset when the stats could not be
+// written to the back end within the processor retry limit
+var errSinkWrite = errors.New("failed to write stats to back end")
+
+// collectDataset retrieves the workloads for a dataset and writes them to the
+// sink, returning the number of workloads written. Normally the workloads are
+// written in batches as the response is decoded, so a large dataset is never
+// held in memory all at once. If the sink fails to accept a batch, it and the
+// rest of the response are held until the response has been read, and the
+// sink is then retried. In per-node mode, each node is queried
+// separately and the merged results are written in one go. Workloads whose
+// sample time has not advanced past the last one written for the dataset are
+// skipped, so a sample is never written twice; st records the newest sample
+// written and the number skipped. The newest sample is only recorded once the
+// whole response has been written, so that a collection that fails partway
+// through is retried in full rather than losing the rest of the sample.
+func collectDataset(ctx context.Context, c *Cluster, ss DBWriter, ds DsInfoEntry, gc globalConfig, st *dsState) (int, error) {
+	var newest int64
+	skipped, written := 0, 0
+	// batches the sink failed to accept while the response was being read,
+	// retried once it has been read so that a slow back end cannot time out
+	// the request
+	var pending [][]PPStatResult
+	write := func(sr []PPStatResult) error {
+		n := 0
+		for _, r := range sr {
+			if st.lastSample > 0 && r.UnixTime <= st.lastSample {
+				continue
+			}
+			newest = max(newest, r.UnixTime)
+			sr[n] = r
+			n++
+		}
+		skipped += len(sr) - n
+		if n == 0 && len(sr) > 0 {
+			return nil
+		}
+		if len(pending) == 0 {
+			err := ss.WritePPStats(ctx, ds, sr[:n])
+			if err == nil {
+				written += n
+				return nil
+			}
+			if errors.Is(err, context.Canceled) {
+				return err
+			}
+			log.Warn("write error, retrying once the workloads have been read",
+				slog.String("cluster", c.ClusterName),
+				slog.String("dataset", ds.Name),
+				slog.Any("error", err))
+		}
+		pending = append(pending, sr[:n])
+		return nil
+	}
+	var err error
+	if !c.perNode || len(c.Nodes) == 0 {
+		_, err = c.StreamPPStats(ctx, ds.Name, write)
+	} else {
+		var sr []PPStatResult
+		sr, err = fetchPPStatsByNode(ctx, c, ss, ds.Name)
+		if err == nil {
+			err = write(sr)
+		}
+	}
+	for _, sr := range pending {
+		if err != nil {
+			break
+		}
+		if err = writePPStats(ctx, c, ss, ds, sr, gc); err == nil {
+			written += len(sr)
+		}
+	}
+	if skipped > 0 {
+		st.duplicates += skipped
+		log.Info("Skipped workloads whose cluster sample time has not advanced",
+			slog.String("cluster", c.ClusterName),
+			slog.String("dataset", ds.Name),
+			slog.Int64("sample_time", st.lastSample),
+			slog.Int("count", skipped))
+	}
+	if err == nil && newest > 0 {
+		st.lastSample = newest
+	}
+	return written, err
+}
+
+// writePPStats writes a batch of workloads to the sink, retrying up to
+// ProcessorMaxRetries times. If every attempt fails, the error wraps
+// errSinkWrite.
+func writePPStats(ctx context.Context, c *Cluster, ss DBWriter, ds DsInfoEntry, sr []PPStatResult, gc globalConfig) error {
+	const maxRetryTime = time.Second * 1280
+	retryTime := time.Second * time.Duration(gc.ProcessorRetryIntvl)
+	log.Debug("Cluster start writing stats to back end",
+		slog.String("cluster", c.ClusterName),
+		slog.String("dataset", ds.Name),
+		slog.Int("count", len(sr)))
+	var err error
+	for i := 1; i <= max(gc.ProcessorMaxRetries, 1); i++ {
+		err = ss.WritePPStats(ctx, ds, sr)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		log.Error("write error, retrying",
+			slog.Any("error", err),
+			slog.Int("retry", i),
+			slog.Duration("retry_in", retryTime))
+		select {
+		case <-time.After(retryTime):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if retryTime < maxRetryTime {
+			retryTime *= 2
+		}
+	}
+	return fmt.Errorf("%w: %w", errSinkWrite, err)
+}
+
+// fetchPPStatsByNode retrieves the workloads for a dataset from each node
+// separately, writing whether each node answered to the sink as the node_up
+// stat so that gaps in the data can be explained.
+func fetchPPStatsByNode(ctx context.Context, c *Cluster, ss DBWriter, dsName string) ([]PPStatResult, error) {
+	sr, nodes, err := c.GetPPStatsByNode(ctx, dsName)
+	if len(nodes) == 0 {
+		return sr, err
+	}
+	now := time.Now().Unix()
+	stats := make([]ClusterStat, 0, len(nodes))
+	for _, n := range nodes {
+		var up float64
+		if n.Up {
+			up = 1
+		}
+		stats = append(stats, ClusterStat{
+			Name:  "node_up",
+			Tags:  map[string]string{"node": strconv.Itoa(n.Node), "dataset": dsName},
+			Value: up,
+			Time:  now,
+		})
+	}
+	// node status is informational so a failure here is not fatal
+	if werr := ss.WriteClusterStats(ctx, stats); werr != nil {
+		log.Warn("Unable to write node status to back end",
+			slog.String("cluster", c.ClusterName),
+			slog.String("dataset", dsName),
+			slog.Any("error", werr))
+	}
+	return sr, err
+}
+
+// sleepUntil waits until the given time, returning false if the context was
+// cancelled first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// makeStatsSink is newStatsSink, as a variable so that tests can substitute
+// their own sink
+var makeStatsSink = newStatsSink
+
+// newStatsSink returns the DBWriter for the cluster's back ends: the
+// configured stats_processor(s), and those of any routing rules that apply to
+// the cluster. Each back end is wrapped in a spool if spool_dir is set. With
+// several back ends, it fans out to them.
+func newStatsSink(c *Cluster, config *tomlConfig, ci int) (DBWriter, error) {
+	gc := config.Global
+	cc := config.Clusters[ci]
+	defaults := gc.processors()
+	var routes []route
+	for _, rc := range config.Routes {
+		rt, err := newRoute(rc)
+		if err != nil {
+			return nil, err
+		}
+		if !rt.matchCluster(c.ClusterName, cc.Hostname) {
+			continue
+		}
+		routes = append(routes, rt)
+		if rt.clusterWide() {
+			// nothing reaches the later routes or the defaults
+			defaults = nil
+			break
+		}
+	}
+	names := slices.Clone(defaults)
+	for _, rt := range routes {
+		for _, name := range rt.backends {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	writers := make([]DBWriter, 0, len(names))
+	for _, name := range names {
+		w, err := getDBWriter(name)
+		if err != nil {
+			return nil, err
+		}
+		if gc.SpoolDir != "" {
+			dir := filepath.Join(gc.SpoolDir, spoolDirName(cc.Hostname), name)
+			w, err = newSpoolWriter(w, c.ClusterName, dir, int64(gc.SpoolMaxSize)<<20,
+				time.Duration(gc.SpoolMaxAge)*time.Second)
+			if err != nil {
+				return nil, err
 			}
 		}
+		writers = append(writers, w)
+	}
+	if len(routes) > 0 {
+		return newRoutingWriter(newFanoutWriter(names, writers, gc), c.ClusterName, defaults, routes), nil
+	}
+	if len(writers) == 1 {
+		return writers[0], nil
 	}
+	return newFanoutWriter(names, writers, gc), nil
 }
 
-// return a DBWriter for the given backend name
+// return a DBWriter for the given backend name, optionally followed by "." and
+// the name of one of its instances
 func getDBWriter(sp string) (DBWriter, error) {
-	switch sp {
-	case discardPluginName:
+	plugin, instance, named := strings.Cut(sp, ".")
+	switch {
+	case plugin == discardPluginName && !named:
 		return GetDiscardWriter(), nil
-	case influxPluginName:
-		return GetInfluxDBWriter(), nil
-	case influxV2PluginName:
-		return GetInfluxDBv2Writer(), nil
-	case promPluginName:
+	case plugin == influxPluginName:
+		return GetInfluxDBWriter(instance), nil
+	case plugin == influxV2PluginName:
+		return GetInfluxDBv2Writer(instance), nil
+	case plugin == promPluginName && !named:
 		return GetPrometheusWriter(), nil
 	default:
 		return nil, fmt.Errorf("unsupported backend plugin %q", sp)
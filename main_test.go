@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestMain initializes the global logger before any tests run.
@@ -43,3 +52,546 @@ func TestGetDBWriter(t *testing.T) {
 		})
 	}
 }
+
+// recordingSink is a DBWriter that records what it is given
+type recordingSink struct {
+	mu       sync.Mutex
+	datasets []*DsInfo
+	written  map[string][]PPStatResult
+	stats    []ClusterStat
+	// fail is returned by WritePPStats if set
+	fail error
+	// wrote is signalled after each WritePPStats call
+	wrote chan string
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		written: make(map[string][]PPStatResult),
+		wrote:   make(chan string, 16),
+	}
+}
+
+func (s *recordingSink) Init(_ context.Context, _ *Cluster, _ *tomlConfig, _ int) error {
+	return nil
+}
+
+func (s *recordingSink) UpdateDatasets(di *DsInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datasets = append(s.datasets, di)
+}
+
+func (s *recordingSink) WritePPStats(_ context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	s.mu.Lock()
+	if s.fail != nil {
+		s.mu.Unlock()
+		return s.fail
+	}
+	s.written[ds.Name] = append(s.written[ds.Name], stats...)
+	s.mu.Unlock()
+	select {
+	case s.wrote <- ds.Name:
+	default:
+	}
+	return nil
+}
+
+func (s *recordingSink) WriteClusterStats(_ context.Context, stats []ClusterStat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = append(s.stats, stats...)
+	return nil
+}
+
+func TestCollectStats(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1}
+
+	done := make(chan struct{})
+	go func() {
+		collectStats(ctx, c, ss, gc)
+		close(done)
+	}()
+
+	// wait for both datasets to be written, then shut the loop down
+	seen := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case name := <-ss.wrote:
+			seen[name] = true
+		case <-timeout:
+			t.Fatalf("timed out waiting for stats, saw %v", seen)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collection loop did not exit on cancellation")
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.datasets) == 0 || len(ss.datasets[0].Datasets) != 2 {
+		t.Errorf("UpdateDatasets not called with the cluster datasets: %v", ss.datasets)
+	}
+	if got := len(ss.written["System"]); got != 2 {
+		t.Errorf("System dataset wrote %d stats, want 2", got)
+	}
+	if got := len(ss.written["nfs_users"]); got != 3 {
+		t.Errorf("nfs_users dataset wrote %d stats, want 3", got)
+	}
+	settings := 0
+	for _, stat := range ss.stats {
+		if stat.Name == "performance_setting" {
+			settings++
+		}
+	}
+	if settings == 0 {
+		t.Error("performance settings were not written")
+	}
+}
+
+func TestCollectStatsExcludedDataset(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	var err error
+	if c.datasets, err = newDatasetFilter(nil, []string{"System"}); err != nil {
+		t.Fatalf("newDatasetFilter failed: %v", err)
+	}
+	ss := newRecordingSink()
+	done := make(chan struct{})
+	go func() {
+		collectStats(ctx, c, ss, globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1})
+		close(done)
+	}()
+	select {
+	case name := <-ss.wrote:
+		if name != "nfs_users" {
+			t.Errorf("wrote dataset %q, want nfs_users", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for nfs_users dataset to be written")
+	}
+	cancel()
+	<-done
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.datasets) == 0 || len(ss.datasets[0].Datasets) != 1 || ss.datasets[0].Datasets[0].Name != "nfs_users" {
+		t.Errorf("UpdateDatasets not called with only the selected dataset: %+v", ss.datasets)
+	}
+	if q := f.lastQuery(ppWorkloadPath); q.Get("dataset") != "nfs_users" {
+		t.Errorf("last workload query for dataset %q, want nfs_users", q.Get("dataset"))
+	}
+	if got := f.hitCount(http.MethodGet, ppWorkloadPath); got != 1 {
+		t.Errorf("workload queries = %d, want 1", got)
+	}
+}
+
+func TestCollectStatsDatasetListFailure(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	// a permanent dataset-listing failure ends the loop
+	f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden,
+		Body: `{"errors":[{"code":"AEC_FORBIDDEN","message":"Privilege check failed"}]}`})
+	ss := newRecordingSink()
+	done := make(chan struct{})
+	go func() {
+		collectStats(ctx, c, ss, globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collection loop should exit when dataset info cannot be retrieved")
+	}
+	if f.hitCount(http.MethodGet, ppWorkloadPath) != 0 {
+		t.Error("no workload queries expected when dataset listing fails")
+	}
+}
+
+func TestCollectStatsSkipsRejectedDataset(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	// the System dataset is rejected, but collection carries on with the next one
+	f.setWorkload("System", map[string]any{
+		"errors": []map[string]string{{"code": "AEC_NOT_FOUND", "message": "Dataset not found"}},
+	})
+	ss := newRecordingSink()
+	done := make(chan struct{})
+	go func() {
+		collectStats(ctx, c, ss, globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1})
+		close(done)
+	}()
+	select {
+	case name := <-ss.wrote:
+		if name != "nfs_users" {
+			t.Errorf("wrote dataset %q, want nfs_users", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for nfs_users dataset to be written")
+	}
+	cancel()
+	<-done
+	if got := f.hitCount(http.MethodGet, ppWorkloadPath); got != 2 {
+		t.Errorf("workload queries = %d, want 2 (rejected dataset must not be retried)", got)
+	}
+}
+
+func TestCollectDatasetPerNode(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.perNode = true
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	f.inject(fakeFault{Path: ppWorkloadPath, Query: url.Values{"nodes": {"2"}}, Count: -1,
+		Status: http.StatusInternalServerError})
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1}
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	n, err := collectDataset(ctx, c, ss, ds, gc, &dsState{})
+	if err != nil {
+		t.Fatalf("collectDataset failed: %v", err)
+	}
+	if n != 2 || len(ss.written["nfs_users"]) != 2 {
+		t.Errorf("wrote %d (%d) results, want 2", n, len(ss.written["nfs_users"]))
+	}
+	want := map[string]float64{"1": 1, "2": 0, "3": 1}
+	if len(ss.stats) != len(want) {
+		t.Fatalf("got %d node stats, want %d: %+v", len(ss.stats), len(want), ss.stats)
+	}
+	for _, stat := range ss.stats {
+		node := stat.Tags["node"]
+		if stat.Name != "node_up" || stat.Tags["dataset"] != "nfs_users" || stat.Value != want[node] {
+			t.Errorf("unexpected node stat %+v", stat)
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		c.perNode = false
+		ss := newRecordingSink()
+		n, err := collectDataset(ctx, c, ss, ds, gc, &dsState{})
+		if err != nil {
+			t.Fatalf("collectDataset failed: %v", err)
+		}
+		if n != 3 {
+			t.Errorf("wrote %d results, want 3", n)
+		}
+		if len(ss.stats) != 0 {
+			t.Errorf("unexpected node stats %+v", ss.stats)
+		}
+		if q := f.lastQuery(ppWorkloadPath); q.Get("nodes") != "all" {
+			t.Errorf("nodes = %q, want all", q.Get("nodes"))
+		}
+	})
+}
+
+func TestCollectDatasetWriteFailure(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ss := newRecordingSink()
+	ss.fail = errors.New("backend down")
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 0}
+	_, err := collectDataset(ctx, c, ss, DsInfoEntry{ID: 1, Name: "nfs_users"}, gc, &dsState{})
+	if !errors.Is(err, errSinkWrite) || !errors.Is(err, ss.fail) {
+		t.Errorf("collectDataset error = %v, want errSinkWrite wrapping %v", err, ss.fail)
+	}
+	if got := f.hitCount(http.MethodGet, ppWorkloadPath); got != 1 {
+		t.Errorf("workload queries = %d, want 1", got)
+	}
+}
+
+func TestCollectDatasetSkipsDuplicates(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1}
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	st := &dsState{}
+	if n, err := collectDataset(ctx, c, ss, ds, gc, st); err != nil || n != 3 {
+		t.Fatalf("collectDataset = %d, %v, want 3 written", n, err)
+	}
+	if st.lastSample != 1700001000 {
+		t.Errorf("last sample = %d, want 1700001000", st.lastSample)
+	}
+
+	// the cluster has not published a new sample yet
+	if n, err := collectDataset(ctx, c, ss, ds, gc, st); err != nil || n != 0 {
+		t.Fatalf("collectDataset = %d, %v, want nothing written", n, err)
+	}
+	if len(ss.written["nfs_users"]) != 3 || st.duplicates != 3 {
+		t.Errorf("wrote %d stats with %d duplicates, want 3 and 3", len(ss.written["nfs_users"]), st.duplicates)
+	}
+
+	f.setWorkload("nfs_users", map[string]any{"workload": []map[string]any{
+		{"node": 1, "time": 1700001030, "username": "alice"},
+	}})
+	if n, err := collectDataset(ctx, c, ss, ds, gc, st); err != nil || n != 1 {
+		t.Fatalf("collectDataset = %d, %v, want 1 written", n, err)
+	}
+	if st.lastSample != 1700001030 {
+		t.Errorf("last sample = %d, want 1700001030", st.lastSample)
+	}
+
+	stats := duplicateSampleStats(map[string]*dsState{"nfs_users": st})
+	if len(stats) != 1 || stats[0].Name != "duplicate_samples" || stats[0].Tags["dataset"] != "nfs_users" ||
+		stats[0].Value != 3 {
+		t.Errorf("unexpected duplicate sample stats %+v", stats)
+	}
+}
+
+func TestCollectDatasetPartialFailure(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	workloads := make([]map[string]any, workloadBatchSize+500)
+	for i := range workloads {
+		workloads[i] = map[string]any{"node": 1, "time": 1700002000, "user_id": i}
+	}
+	resp := map[string]any{"workload": workloads}
+	f.setWorkload("nfs_users", resp)
+	body, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the response is cut off after the first batch
+	f.inject(fakeFault{Path: ppWorkloadPath, Count: 1, Status: http.StatusOK, Body: string(body[:len(body)-100])})
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1}
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	st := &dsState{}
+	if _, err := collectDataset(ctx, c, ss, ds, gc, st); err == nil {
+		t.Fatal("expected collectDataset to fail on a truncated response")
+	}
+	if len(ss.written["nfs_users"]) != workloadBatchSize {
+		t.Errorf("wrote %d stats before the failure, want %d", len(ss.written["nfs_users"]), workloadBatchSize)
+	}
+	if st.lastSample != 0 {
+		t.Errorf("last sample = %d after a partial write, want 0", st.lastSample)
+	}
+
+	// the retry writes the whole sample
+	n, err := collectDataset(ctx, c, ss, ds, gc, st)
+	if err != nil || n != len(workloads) {
+		t.Fatalf("collectDataset = %d, %v, want %d written", n, err, len(workloads))
+	}
+	if st.lastSample != 1700002000 || st.duplicates != 0 {
+		t.Errorf("last sample = %d with %d duplicates, want 1700002000 and 0", st.lastSample, st.duplicates)
+	}
+}
+
+// flakySink is a recordingSink whose first failures WritePPStats calls fail
+type flakySink struct {
+	*recordingSink
+	failures int
+}
+
+func (s *flakySink) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	s.mu.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.mu.Unlock()
+		return errors.New("backend busy")
+	}
+	s.mu.Unlock()
+	return s.recordingSink.WritePPStats(ctx, ds, stats)
+}
+
+func TestCollectDatasetRetriesAfterRead(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	// shorter than the sink retry interval, and covering the response read
+	c.RequestTimeout = 2 * time.Second
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	// enough data, that does not compress away, for the response to still be
+	// being read when the first batch is written
+	workloads := make([]map[string]any, 3*workloadBatchSize)
+	for i := range workloads {
+		path := make([]byte, 64)
+		_, _ = rand.Read(path)
+		workloads[i] = map[string]any{"node": 1, "time": 1700002000, "user_id": i,
+			"path": "/ifs/" + hex.EncodeToString(path)}
+	}
+	f.setWorkload("nfs_users", map[string]any{"workload": workloads})
+	ss := &flakySink{recordingSink: newRecordingSink(), failures: 1}
+	gc := globalConfig{ProcessorMaxRetries: 3, ProcessorRetryIntvl: 3}
+	n, err := collectDataset(ctx, c, ss, DsInfoEntry{ID: 1, Name: "nfs_users"}, gc, &dsState{})
+	if err != nil || n != len(workloads) {
+		t.Fatalf("collectDataset = %d, %v, want %d written", n, err, len(workloads))
+	}
+	written := ss.written["nfs_users"]
+	for i, w := range written {
+		if w.UserID == nil || *w.UserID != i {
+			t.Fatalf("workload %d has user id %v, want the workloads in order", i, w.UserID)
+		}
+	}
+}
+
+func TestCollectDatasetsBackoff(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeBasic)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	di, err := c.GetDataSetInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetDataSetInfo failed: %v", err)
+	}
+	f.inject(fakeFault{Path: ppWorkloadPath, Query: url.Values{"dataset": {"System"}}, Count: -1,
+		Status: http.StatusInternalServerError})
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1, DatasetConcurrency: 2}
+	states := make(map[string]*dsState)
+
+	sampleTime, err := collectDatasets(ctx, c, ss, di.Datasets, gc, states)
+	if err != nil {
+		t.Fatalf("collectDatasets failed: %v", err)
+	}
+	if sampleTime != 1700001000 {
+		t.Errorf("sample time = %d, want 1700001000", sampleTime)
+	}
+	if got := len(ss.written["nfs_users"]); got != 3 {
+		t.Errorf("nfs_users dataset wrote %d stats, want 3", got)
+	}
+	st := states["System"]
+	if st == nil || st.failures != 1 || !st.next.After(time.Now()) {
+		t.Fatalf("System state = %+v, want one failure with a future retry time", st)
+	}
+	queries := f.hitCount(http.MethodGet, ppWorkloadPath)
+
+	// the failing dataset is skipped until its retry time, the other is not
+	if _, err := collectDatasets(ctx, c, ss, di.Datasets, gc, states); err != nil {
+		t.Fatalf("collectDatasets failed: %v", err)
+	}
+	if got := f.hitCount(http.MethodGet, ppWorkloadPath) - queries; got != 1 {
+		t.Errorf("workload queries = %d, want 1 (System must be backing off)", got)
+	}
+	// nfs_users has no new sample, so nothing more is written
+	if got := len(ss.written["nfs_users"]); got != 3 {
+		t.Errorf("nfs_users dataset wrote %d stats, want 3", got)
+	}
+	if got := states["nfs_users"].duplicates; got != 3 {
+		t.Errorf("nfs_users duplicates = %d, want 3", got)
+	}
+
+	// once it succeeds, its backoff is reset
+	f.clearFaults()
+	st.next = time.Time{}
+	if _, err := collectDatasets(ctx, c, ss, di.Datasets, gc, states); err != nil {
+		t.Fatalf("collectDatasets failed: %v", err)
+	}
+	if st.failures != 0 || len(ss.written["System"]) != 2 {
+		t.Errorf("System state = %+v with %d stats written, want reset after success",
+			*st, len(ss.written["System"]))
+	}
+
+	// deleted datasets are forgotten
+	if _, err := collectDatasets(ctx, c, ss, di.Datasets[1:], gc, states); err != nil {
+		t.Fatalf("collectDatasets failed: %v", err)
+	}
+	if _, ok := states[di.Datasets[0].Name]; ok {
+		t.Errorf("state kept for deleted dataset %s", di.Datasets[0].Name)
+	}
+}
+
+func TestCollectDatasetsConcurrent(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	ctx := context.Background()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	di, err := c.GetDataSetInfo(ctx)
+	if err != nil {
+		t.Fatalf("GetDataSetInfo failed: %v", err)
+	}
+	// a slow dataset does not hold up the others
+	f.inject(fakeFault{Path: ppWorkloadPath, Query: url.Values{"dataset": {"System"}}, Count: 1,
+		Delay: 500 * time.Millisecond})
+	ss := newRecordingSink()
+	gc := globalConfig{ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1, DatasetConcurrency: 2}
+	if _, err := collectDatasets(ctx, c, ss, di.Datasets, gc, make(map[string]*dsState)); err != nil {
+		t.Fatalf("collectDatasets failed: %v", err)
+	}
+	if first := <-ss.wrote; first != "nfs_users" {
+		t.Errorf("first dataset written = %q, want nfs_users", first)
+	}
+
+	t.Run("write failure", func(t *testing.T) {
+		ss := newRecordingSink()
+		ss.fail = errors.New("backend down")
+		gc := gc
+		gc.ProcessorRetryIntvl = 0
+		_, err := collectDatasets(ctx, c, ss, di.Datasets, gc, make(map[string]*dsState))
+		if !errors.Is(err, errSinkWrite) {
+			t.Errorf("collectDatasets error = %v, want %v", err, errSinkWrite)
+		}
+	})
+}
+
+func TestNextPollTime(t *testing.T) {
+	const interval = 30 * time.Second
+	sample := int64(1700001000)
+	at := func(offset time.Duration) time.Time { return time.Unix(sample, 0).Add(offset) }
+	tests := []struct {
+		name  string
+		start time.Time
+		now   time.Time
+		want  time.Time
+	}{
+		{"aligned to the next sample", at(2 * time.Second), at(5 * time.Second), at(32 * time.Second)},
+		{"collection time does not drift", at(2 * time.Second), at(20 * time.Second), at(32 * time.Second)},
+		{"never sooner than the interval", at(20 * time.Second), at(21 * time.Second), at(62 * time.Second)},
+		{"slow collection skips a sample", at(2 * time.Second), at(40 * time.Second), at(62 * time.Second)},
+		{"old sample time", at(10 * time.Minute), at(10*time.Minute + time.Second), at(10*time.Minute + 32*time.Second)},
+		{"cluster clock ahead", at(-10 * time.Minute), at(-10 * time.Minute), at(-9*time.Minute - 28*time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPollTime(tt.start, tt.now, sample, interval); !got.Equal(tt.want) {
+				t.Errorf("nextPollTime = %v, want %v", got.Sub(at(0)), tt.want.Sub(at(0)))
+			}
+		})
+	}
+}
@@ -41,7 +41,6 @@ type PrometheusSink struct {
 	clusterName       string
 	instanceLabelName string
 	cluster           *Cluster // needed to enable per-cluster export id lookup
-	exports           exportMap
 
 	dsm    promDsMap
 	client PrometheusClient
@@ -53,6 +52,10 @@ type PrometheusSink struct {
 const namespace = "isilon"
 const basePPName = "ppstat"
 
+// promExpiryMargin is added to the time a sample is exposed for, to allow for
+// late polls
+const promExpiryMargin = 30 * time.Second
+
 // promMetric holds the Prometheus metadata exposed by the "/metrics"
 // endpoint for a given partitioned performance stat within a dataset
 type promMetric struct {
@@ -297,14 +300,18 @@ func (p *PrometheusClient) Connect(ctx context.Context) error {
 // Init initializes an PrometheusSink so that points can be "written"
 // (which means exposed via http in the case of Prometheus)
 func (s *PrometheusSink) Init(ctx context.Context, cluster *Cluster, config *tomlConfig, ci int) error {
+	s.Lock()
 	s.clusterName = cluster.ClusterName
 	s.cluster = cluster
+	s.Unlock()
+	if s.client.server != nil {
+		// re-initialized for a new connection; keep serving the current metrics
+		return nil
+	}
 	if config.Prometheus.InstanceLabelName != nil {
 		s.instanceLabelName = *config.Prometheus.InstanceLabelName
 	}
 	promconf := config.Prometheus
-	gc := config.Global
-	s.exports = newExportMap(gc.LookupExportIDs)
 	port := config.Clusters[ci].PrometheusPort
 	if port == nil {
 		return fmt.Errorf("prometheus plugin initialization failed - missing port definition for cluster %v", cluster)
@@ -336,11 +343,19 @@ func (s *PrometheusSink) Init(ctx context.Context, cluster *Cluster, config *tom
 // CreateDataset assigns the provided dataset to the map
 // and creates and tracks the associated Prometheus gauges
 func (s *PrometheusSink) CreateDataset(id int, entry DsInfoEntry) {
-	// if export_id lookup is enabled, we need to add the export_path here
-	if s.exports.enabled {
+	// if export_id, share_name or identity lookup is enabled, we need to add
+	// the export_path, share_path or raw user/group id labels here
+	if s.cluster != nil {
 		for _, m := range entry.Metrics {
-			if m == "export_id" {
+			switch {
+			case m == "export_id" && s.cluster.exports != nil:
 				entry.Metrics = append(entry.Metrics, "export_path")
+			case m == "share_name" && s.cluster.shares != nil:
+				entry.Metrics = append(entry.Metrics, "share_path")
+			case m == "username" && s.cluster.identities != nil:
+				entry.Metrics = append(entry.Metrics, "user_id")
+			case m == "groupname" && s.cluster.identities != nil:
+				entry.Metrics = append(entry.Metrics, "group_id")
 			}
 		}
 	}
@@ -376,33 +391,16 @@ func (s *PrometheusSink) UpdateDatasets(di *DsInfo) {
 		nsdMap[v.ID] = v
 	}
 
-	// compare each possible slot to what we currently have
-	// we are going to assert/assume that the System dataset is immutable so skip checking dataset 0
-	for id := 1; id <= MaxDsID; id++ {
-		cur, ok := s.dsm[id]
-		if ok {
-			new, ok := nsdMap[id]
-			if !ok {
-				// dataset has been deleted
-				s.ClearDataset(id)
-				continue
-			}
-			if cur.ds.CreationTime == new.CreationTime {
-				// dataset creation time matches; dataset has not changed
-				continue
-			}
-			// delete old entry
+	// drop any dataset that has been deleted or redefined; a dataset whose
+	// creation time is unchanged has not changed
+	for id, cur := range s.dsm {
+		if new, ok := nsdMap[id]; !ok || new.CreationTime != cur.ds.CreationTime {
 			s.ClearDataset(id)
-			// create new
-			s.CreateDataset(id, new)
-		} else {
-			// dataset does not currently exist, has it been added?
-			new, ok := nsdMap[id]
-			if !ok {
-				// no, there's no new entry either
-				continue
-			}
-			// New entry so populate it and generate gauges
+		}
+	}
+	// then create any that are new or were redefined
+	for id, new := range nsdMap {
+		if _, ok := s.dsm[id]; !ok {
 			s.CreateDataset(id, new)
 		}
 	}
@@ -418,6 +416,17 @@ func (s *PrometheusSink) Describe(ch chan<- *prometheus.Desc) {
 	prometheus.NewGauge(prometheus.GaugeOpts{Name: "Dummy", Help: "Dummy"}).Describe(ch)
 }
 
+// sampleExpiry returns how long a sample is exposed for: two of the cluster's
+// poll intervals plus a margin, so that it is still there for every scrape
+// until the next poll replaces it, even if that poll is late. The caller must
+// hold the lock.
+func (s *PrometheusSink) sampleExpiry() time.Duration {
+	if s.cluster == nil {
+		return promExpiryMargin
+	}
+	return 2*s.cluster.pollInterval + promExpiryMargin
+}
+
 // Expire removes Samples that have expired.
 func (s *PrometheusSink) Expire() {
 	now := time.Now()
@@ -519,6 +528,16 @@ func (s *PrometheusSink) addMetricFamily(sample *Sample, mname string, desc stri
 // (in the case of Prometheus, this means adding them to the data exposed via http
 // that the Prometheus server will scrape)
 func (s *PrometheusSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppstats []PPStatResult) error {
+	// Resolve the tags before taking the lock: name lookups may call the
+	// cluster API, which must not hold up scrapes
+	s.Lock()
+	cluster := s.cluster
+	s.Unlock()
+	ppTags := make([]ptTags, len(ppstats))
+	for i, ppstat := range ppstats {
+		ppTags[i] = tagsForPPStat(ctx, ppstat, cluster)
+	}
+
 	// Currently only one thread writing at any one time, but let's protect ourselves
 	s.Lock()
 	defer s.Unlock()
@@ -526,9 +545,9 @@ func (s *PrometheusSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppsta
 	now := time.Now()
 
 	dsi := s.dsm[ds.ID]
-	for _, ppstat := range ppstats {
+	for i, ppstat := range ppstats {
 		fieldMap := fieldsForPPStat(ppstat)
-		tags := tagsForPPStat(ctx, ppstat, s.cluster, s.exports)
+		tags := ppTags[i]
 		sampleID := CreateSampleID(tags)
 		labels := make(prometheus.Labels)
 		labels["cluster"] = s.clusterName
@@ -582,7 +601,7 @@ func (s *PrometheusSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppsta
 				Labels:     labels,
 				Value:      value,
 				Timestamp:  time.Unix(ppstat.UnixTime, 0),
-				Expiration: now.Add(30 * time.Second),
+				Expiration: now.Add(s.sampleExpiry()),
 			}
 			s.addMetricFamily(sample, fullname, description, sampleID)
 		}
@@ -590,3 +609,31 @@ func (s *PrometheusSink) WritePPStats(ctx context.Context, ds DsInfoEntry, ppsta
 
 	return nil
 }
+
+// WriteClusterStats takes an array of ClusterStats and exposes each as a
+// gauge named after the stat, e.g. isilon_ppstat_node_up
+func (s *PrometheusSink) WriteClusterStats(_ context.Context, stats []ClusterStat) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for _, stat := range stats {
+		labels := make(prometheus.Labels)
+		for k, v := range stat.Tags {
+			labels[k] = v
+		}
+		labels["cluster"] = s.clusterName
+		if s.instanceLabelName != "" {
+			labels[s.instanceLabelName] = s.clusterName
+		}
+		sample := &Sample{
+			Labels:     labels,
+			Value:      stat.Value,
+			Timestamp:  time.Unix(stat.Time, 0),
+			Expiration: now.Add(s.sampleExpiry()),
+		}
+		name := namespace + "_" + basePPName + "_" + stat.Name
+		s.addMetricFamily(sample, name, clusterStatHelp[stat.Name], CreateSampleID(stat.Tags))
+	}
+	return nil
+}
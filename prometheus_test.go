@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -181,6 +182,32 @@ func TestUpdateDatasets(t *testing.T) {
 			t.Error("dsm[2] should have been added")
 		}
 	})
+
+	t.Run("dataset ids beyond the default limit are tracked", func(t *testing.T) {
+		s := makeSink()
+		s.UpdateDatasets(&DsInfo{Datasets: []DsInfoEntry{makeDs(1, "ds1", 2000)}})
+
+		di := &DsInfo{Datasets: []DsInfoEntry{makeDs(7, "ds7", 6000), makeDs(12, "ds12", 7000)}}
+		s.UpdateDatasets(di)
+		for _, id := range []int{7, 12} {
+			if _, ok := s.dsm[id]; !ok {
+				t.Errorf("dsm[%d] should have been added", id)
+			}
+		}
+		if _, ok := s.dsm[1]; ok {
+			t.Error("dsm[1] should have been removed")
+		}
+	})
+
+	t.Run("system dataset changes are tracked", func(t *testing.T) {
+		s := makeSink()
+		s.UpdateDatasets(&DsInfo{Datasets: []DsInfoEntry{makeDs(0, "System", 1000)}})
+
+		s.UpdateDatasets(&DsInfo{Datasets: []DsInfoEntry{makeDs(0, "System", 1500)}})
+		if s.dsm[0].ds.CreationTime != 1500 {
+			t.Errorf("creation time = %d, want 1500", s.dsm[0].ds.CreationTime)
+		}
+	})
 }
 
 func TestExpire(t *testing.T) {
@@ -221,3 +248,24 @@ func TestExpire(t *testing.T) {
 		t.Errorf("LabelSet[cluster] = %d, want 1 (only active sample)", fam.LabelSet["cluster"])
 	}
 }
+
+func TestSampleExpiry(t *testing.T) {
+	s := &PrometheusSink{
+		cluster: &Cluster{pollInterval: 60 * time.Second},
+		fam:     make(map[string]*MetricFamily),
+	}
+	start := time.Now()
+	err := s.WriteClusterStats(context.Background(), []ClusterStat{{Name: "node_up", Value: 1, Time: start.Unix()}})
+	if err != nil {
+		t.Fatalf("WriteClusterStats failed: %v", err)
+	}
+	// the sample outlives the next poll, even a late one
+	for _, sample := range s.fam["isilon_ppstat_node_up"].Samples {
+		if exp := sample.Expiration.Sub(start); exp < 2*time.Minute+promExpiryMargin {
+			t.Errorf("sample expires after %v, want at least two poll intervals plus %v", exp, promExpiryMargin)
+		}
+	}
+	if len(s.fam["isilon_ppstat_node_up"].Samples) != 1 {
+		t.Error("cluster stat not exposed")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// retryPolicy controls how failed OneFS API requests are retried
+type retryPolicy struct {
+	maxRetries   int           // total attempts per request
+	initialDelay time.Duration // delay before the first retry
+	maxDelay     time.Duration // upper limit on any single delay, including Retry-After
+}
+
+// defaultRetryPolicy returns the retry policy used if none is configured
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		maxRetries:   defaultMaxRetries,
+		initialDelay: defaultRetryInitialIntvl * time.Second,
+		maxDelay:     defaultRetryMaxIntvl * time.Second,
+	}
+}
+
+// delay returns how long to wait before the nth retry (counting from 1).
+// The delay doubles with each retry up to maxDelay, with "equal jitter"
+// applied so that collectors for many clusters don't retry in lockstep.
+// A server-provided Retry-After is honoured if it is longer, up to maxDelay.
+func (p retryPolicy) delay(n int, retryAfter time.Duration) time.Duration {
+	d := p.initialDelay
+	for i := 1; i < n && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if d > 1 {
+		d = d/2 + rand.N(d/2)
+	}
+	if retryAfter > d {
+		d = retryAfter
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// retryReason classifies an error from an API request. It returns a short
+// description of the failure for logging and whether the request is worth
+// retrying against the same endpoint.
+func retryReason(err error) (string, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return "rate limited", true
+		}
+		return fmt.Sprintf("HTTP %d", apiErr.StatusCode), retryableStatus(apiErr.StatusCode)
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "DNS failure", true
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused", true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection reset", true
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "host unreachable", true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout", true
+	}
+	return "error", false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be
+// either a number of seconds or an HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// doWithRetry sends the request returned by build, retrying according to the
+// cluster's retry policy. A new request is built for each attempt. With more
+// than one endpoint, retryable failures and server errors move on to the next
+// endpoint, and each endpoint is tried once before backing off. If reauth is
+// non-nil, it is called to establish a new session after switching endpoint
+// or when the cluster responds with 401, with the connection generation the
+// failed request was made in. Any response that is not retried is returned to
+// the caller, who must close its body.
+func (c *Cluster) doWithRetry(ctx context.Context, path string, build func() (*http.Request, error),
+	reauth func(context.Context, uint64) error) (*http.Response, error) {
+	var lastErr error
+	backoffs := 0
+	failovers := 0
+	for attempt := 1; attempt <= c.retry.maxRetries; attempt++ {
+		gen := c.generation()
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Do(req)
+		var retryAfter time.Duration
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		} else {
+			if resp.StatusCode == http.StatusUnauthorized && reauth != nil {
+				lastErr = newAPIError(c.name(), path, resp)
+				_ = resp.Body.Close()
+				log.Log(ctx, LevelNotice, "Session-based authentication to cluster failed, attempting to re-authenticate",
+					slog.String("cluster", c.name()))
+				if err := reauth(ctx, gen); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if !retryableStatus(resp.StatusCode) &&
+				(resp.StatusCode < http.StatusInternalServerError || len(c.endpoints) < 2) {
+				return resp, nil
+			}
+			retryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			err = newAPIError(c.name(), path, resp)
+			_ = resp.Body.Close()
+		}
+		lastErr = err
+		reason, retryable := retryReason(err)
+		// a failure on one node may not affect the others
+		failover := len(c.endpoints) > 1 && (retryable || shouldFailover(err) || isServerError(err))
+		if !retryable && !failover {
+			return nil, err
+		}
+		if attempt == c.retry.maxRetries {
+			break
+		}
+		if failover {
+			prev := c.endpoint()
+			// another request may already have moved on from the failed endpoint
+			if gen, switched := c.nextEndpoint(gen); switched && reauth != nil {
+				// sessions are per node
+				if err := reauth(ctx, gen); err != nil {
+					return nil, err
+				}
+			}
+			failovers++
+			if failovers%len(c.endpoints) != 0 {
+				log.Warn("Request to cluster failed, trying next endpoint",
+					slog.String("cluster", c.name()),
+					slog.String("path", path),
+					slog.String("reason", reason),
+					slog.Int("attempt", attempt),
+					slog.String("from", prev),
+					slog.String("to", c.endpoint()),
+					slog.Any("error", err))
+				continue
+			}
+		}
+		backoffs++
+		d := c.retry.delay(backoffs, retryAfter)
+		log.Warn("Request to cluster failed, retrying",
+			slog.String("cluster", c.name()),
+			slog.String("path", path),
+			slog.String("reason", reason),
+			slog.Int("attempt", attempt),
+			slog.Any("error", err),
+			slog.Duration("retry_in", d))
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("max retries exceeded for %s: %w", c.endpoint(), lastErr)
+}
+
+// retryableStatus reports whether an HTTP status indicates a transient
+// condition that is worth retrying
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isServerError reports whether err is a 5xx response from the API
+func isServerError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{maxRetries: 10, initialDelay: time.Second, maxDelay: 8 * time.Second}
+	for n := 1; n <= 6; n++ {
+		base := time.Second << (n - 1)
+		if base > p.maxDelay {
+			base = p.maxDelay
+		}
+		for range 50 {
+			d := p.delay(n, 0)
+			if d < base/2 || d > base {
+				t.Fatalf("delay(%d) = %v, want between %v and %v", n, d, base/2, base)
+			}
+		}
+	}
+	if d := p.delay(1, 5*time.Second); d != 5*time.Second {
+		t.Errorf("delay with Retry-After 5s = %v, want 5s", d)
+	}
+	if d := p.delay(1, time.Hour); d != p.maxDelay {
+		t.Errorf("delay with Retry-After 1h = %v, want %v", d, p.maxDelay)
+	}
+}
+
+func TestRetryReason(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		reason    string
+		retryable bool
+	}{
+		{"rate limited", &APIError{StatusCode: http.StatusTooManyRequests}, "rate limited", true},
+		{"bad gateway", &APIError{StatusCode: http.StatusBadGateway}, "HTTP 502", true},
+		{"unavailable", &APIError{StatusCode: http.StatusServiceUnavailable}, "HTTP 503", true},
+		{"gateway timeout", &APIError{StatusCode: http.StatusGatewayTimeout}, "HTTP 504", true},
+		{"internal error", &APIError{StatusCode: http.StatusInternalServerError}, "HTTP 500", false},
+		{"not found", &APIError{StatusCode: http.StatusNotFound}, "HTTP 404", false},
+		{"dns", &url.Error{Op: "Get", URL: "https://x", Err: &net.DNSError{Err: "no such host", Name: "x"}}, "DNS failure", true},
+		{"refused", &url.Error{Op: "Get", URL: "https://x", Err: syscall.ECONNREFUSED}, "connection refused", true},
+		{"reset", &url.Error{Op: "Get", URL: "https://x", Err: syscall.ECONNRESET}, "connection reset", true},
+		{"eof", &url.Error{Op: "Get", URL: "https://x", Err: io.EOF}, "connection reset", true},
+		{"unreachable", &url.Error{Op: "Get", URL: "https://x", Err: syscall.EHOSTUNREACH}, "host unreachable", true},
+		{"timeout", &url.Error{Op: "Get", URL: "https://x", Err: context.DeadlineExceeded}, "timeout", true},
+		{"other", errors.New("something else"), "error", false},
+		{"wrapped", fmt.Errorf("auth failed: %w", &APIError{StatusCode: http.StatusTooManyRequests}), "rate limited", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, retryable := retryReason(tt.err)
+			if reason != tt.reason || retryable != tt.retryable {
+				t.Errorf("retryReason() = %q, %v, want %q, %v", reason, retryable, tt.reason, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"30", 30 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRestGetRetries(t *testing.T) {
+	ctx := context.Background()
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.retry.maxRetries = 3
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		before := f.hitCount(http.MethodGet, dsPath)
+		f.inject(fakeFault{Path: dsPath, Count: 2, Status: http.StatusTooManyRequests,
+			Header: http.Header{"Retry-After": []string{"0"}}})
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, dsPath) - before; got != 3 {
+			t.Errorf("dataset requests = %d, want 3", got)
+		}
+	})
+
+	t.Run("dropped connection", func(t *testing.T) {
+		before := f.hitCount(http.MethodGet, dsPath)
+		f.inject(fakeFault{Path: dsPath, Count: 1, Drop: true})
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo failed: %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, dsPath) - before; got != 2 {
+			t.Errorf("dataset requests = %d, want 2", got)
+		}
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		before := f.hitCount(http.MethodGet, dsPath)
+		f.inject(fakeFault{Path: dsPath, Count: 3, Status: http.StatusServiceUnavailable})
+		_, err := c.GetDataSetInfo(ctx)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected HTTP 503 APIError, got %v", err)
+		}
+		if got := f.hitCount(http.MethodGet, dsPath) - before; got != 3 {
+			t.Errorf("dataset requests = %d, want 3", got)
+		}
+	})
+
+	t.Run("client error not retried", func(t *testing.T) {
+		before := f.hitCount(http.MethodGet, dsPath)
+		f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden})
+		if _, err := c.GetDataSetInfo(ctx); err == nil {
+			t.Fatal("expected error for HTTP 403")
+		}
+		if got := f.hitCount(http.MethodGet, dsPath) - before; got != 1 {
+			t.Errorf("dataset requests = %d, want 1", got)
+		}
+	})
+}
+
+func TestAuthenticateRetries(t *testing.T) {
+	f := newFakePAPI(t)
+	c := f.cluster(authtypeSession)
+	c.retry.maxRetries = 3
+	f.inject(fakeFault{Method: http.MethodPost, Path: sessionPath, Count: 1, Status: http.StatusServiceUnavailable})
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if got := f.hitCount(http.MethodPost, sessionPath); got != 2 {
+		t.Errorf("login requests = %d, want 2", got)
+	}
+}
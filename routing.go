@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+)
+
+// wRegular is the workload type that routing rules use for a dataset's
+// regular workloads, which have no workload_type
+const wRegular = "Regular"
+
+// workloadTypeOf returns the workload type of a workload for routing
+func workloadTypeOf(ppstat PPStatResult) string {
+	if ppstat.WorkloadType == nil {
+		return wRegular
+	}
+	return *ppstat.WorkloadType
+}
+
+// route is a compiled routing rule
+type route struct {
+	clusters      []namePattern
+	datasets      []namePattern
+	workloadTypes []string
+	backends      []string
+}
+
+// newRoute compiles a routing rule. The back end names are checked by
+// readConfig.
+func newRoute(rc routeConfig) (route, error) {
+	r := route{workloadTypes: rc.WorkloadTypes, backends: rc.Backends}
+	var err error
+	if r.clusters, err = compileNamePatterns("clusters", rc.Clusters); err != nil {
+		return route{}, err
+	}
+	if r.datasets, err = compileNamePatterns("datasets", rc.Datasets); err != nil {
+		return route{}, err
+	}
+	for _, wt := range rc.WorkloadTypes {
+		if wt != wRegular && wt != wPinned && !isValidWorkloadType(wt) {
+			return route{}, fmt.Errorf("workload_types: invalid workload type %q", wt)
+		}
+	}
+	if len(rc.Backends) == 0 {
+		return route{}, fmt.Errorf("no backends given")
+	}
+	for i, name := range rc.Backends {
+		if slices.Contains(rc.Backends[:i], name) {
+			return route{}, fmt.Errorf("backends lists %q more than once", name)
+		}
+	}
+	return r, nil
+}
+
+// matchCluster reports whether the route applies to a cluster, given its
+// name and configured hostname
+func (r route) matchCluster(names ...string) bool {
+	return len(r.clusters) == 0 || matchAny(r.clusters, names...)
+}
+
+// matchWorkload reports whether the route matches a workload of the dataset
+func (r route) matchWorkload(ds DsInfoEntry, ppstat PPStatResult) bool {
+	if len(r.datasets) > 0 && !matchAny(r.datasets, ds.Name, strconv.Itoa(ds.ID)) {
+		return false
+	}
+	return len(r.workloadTypes) == 0 || slices.Contains(r.workloadTypes, workloadTypeOf(ppstat))
+}
+
+// clusterWide reports whether the route matches everything from the
+// clusters it applies to
+func (r route) clusterWide() bool {
+	return len(r.datasets) == 0 && len(r.workloadTypes) == 0
+}
+
+// routingWriter is a DBWriter that sends each workload to the back ends of the
+// first route that matches it, or to the default back ends if none does.
+// Cluster stats go to the back ends of a route that matches the whole cluster,
+// if there is one, otherwise to the default back ends. The back ends are
+// written through a fanoutWriter, so a failing one does not hold up the others.
+type routingWriter struct {
+	*fanoutWriter
+	clusterName  string
+	routes       []route
+	routeTargets [][]*fanoutTarget // the back ends of each route
+	defaults     []*fanoutTarget
+	cluster      []*fanoutTarget // where the cluster stats go
+}
+
+// newRoutingWriter returns a routingWriter for the routes that apply to a
+// cluster, writing through f
+func newRoutingWriter(f *fanoutWriter, clusterName string, defaults []string, routes []route) *routingWriter {
+	r := &routingWriter{fanoutWriter: f, clusterName: clusterName, routes: routes, defaults: f.targetsNamed(defaults)}
+	r.cluster = r.defaults
+	for _, rt := range routes {
+		targets := f.targetsNamed(rt.backends)
+		r.routeTargets = append(r.routeTargets, targets)
+		if rt.clusterWide() {
+			r.cluster = targets
+		}
+	}
+	return r
+}
+
+// WritePPStats writes each workload to the back ends it is routed to. It only
+// fails if every back end is down, so that the write is retried. Otherwise the
+// workloads of a route whose back ends are all down are queued for retry on
+// those back ends, like any other failed write of a fanoutWriter, so that one
+// route's back ends can neither stop collection nor cause duplicate writes to
+// the others.
+func (r *routingWriter) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	// group the workloads by route, keeping their order; -1 is the default
+	groups := make(map[int][]PPStatResult)
+	var order []int
+	for _, ppstat := range stats {
+		i := slices.IndexFunc(r.routes, func(rt route) bool { return rt.matchWorkload(ds, ppstat) })
+		if _, ok := groups[i]; !ok {
+			order = append(order, i)
+		}
+		groups[i] = append(groups[i], ppstat)
+	}
+	writers := make([]func(context.Context, DBWriter) error, len(order))
+	errs := make([]error, len(order))
+	for j, i := range order {
+		writers[j] = func(ctx context.Context, w DBWriter) error {
+			return w.WritePPStats(ctx, ds, groups[i])
+		}
+		errs[j] = r.write(ctx, r.targetsOf(i), writers[j])
+	}
+	err := errors.Join(errs...)
+	if err == nil || errors.Is(err, context.Canceled) ||
+		!slices.ContainsFunc(r.fanoutWriter.targets, func(t *fanoutTarget) bool { return !t.down() }) {
+		return err
+	}
+	for j, err := range errs {
+		if err == nil {
+			continue
+		}
+		var backends []string
+		for _, t := range r.targetsOf(order[j]) {
+			backends = append(backends, t.name)
+			r.enqueueTarget(t, writers[j])
+		}
+		log.Warn("Unable to write routed workloads to back end, queued them for retry",
+			slog.String("cluster", r.clusterName),
+			slog.String("dataset", ds.Name),
+			slog.Any("backends", backends),
+			slog.Int("count", len(groups[order[j]])),
+			slog.Any("error", err))
+	}
+	return nil
+}
+
+// targetsOf returns the back ends of route i, or the default back ends if i is -1
+func (r *routingWriter) targetsOf(i int) []*fanoutTarget {
+	if i < 0 {
+		return r.defaults
+	}
+	return r.routeTargets[i]
+}
+
+// WriteClusterStats writes the stats to the cluster's back ends
+func (r *routingWriter) WriteClusterStats(ctx context.Context, stats []ClusterStat) error {
+	return r.write(ctx, r.cluster, func(ctx context.Context, w DBWriter) error {
+		return w.WriteClusterStats(ctx, stats)
+	})
+}
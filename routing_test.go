@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRoutingWriter(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"default", "team", "system"}
+	sinks := map[string]*recordingSink{}
+	var writers []DBWriter
+	for _, name := range names {
+		sinks[name] = newRecordingSink()
+		writers = append(writers, sinks[name])
+	}
+	var routes []route
+	for _, rc := range []routeConfig{
+		{Datasets: []string{"team_*"}, Backends: []string{"team"}},
+		{WorkloadTypes: []string{wSystem, wExcluded}, Backends: []string{"system", "default"}},
+	} {
+		rt, err := newRoute(rc)
+		if err != nil {
+			t.Fatalf("newRoute failed: %v", err)
+		}
+		routes = append(routes, rt)
+	}
+	gc := globalConfig{ProcessorMaxRetries: 1}
+	r := newRoutingWriter(newFanoutWriter(names, writers, gc), "test", []string{"default"}, routes)
+
+	workloads := []PPStatResult{
+		{Node: 1, Username: strPtr("alice")},
+		{Node: 1, WorkloadType: strPtr(wSystem)},
+		{Node: 2, Username: strPtr("bob")},
+	}
+	for _, ds := range []DsInfoEntry{{ID: 1, Name: "nfs_users"}, {ID: 2, Name: "team_users"}} {
+		if err := r.WritePPStats(ctx, ds, workloads); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+	}
+	if err := r.WriteClusterStats(ctx, []ClusterStat{{Name: "node_up", Value: 1}}); err != nil {
+		t.Fatalf("WriteClusterStats failed: %v", err)
+	}
+
+	tests := []struct {
+		sink    string
+		dataset string
+		want    int
+	}{
+		{"default", "nfs_users", 3}, // the regular workloads, and the System one through the second route
+		{"system", "nfs_users", 1},
+		{"team", "nfs_users", 0},
+		{"team", "team_users", 3}, // the first matching route wins
+		{"default", "team_users", 0},
+		{"system", "team_users", 0},
+	}
+	for _, tt := range tests {
+		if got := len(sinks[tt.sink].written[tt.dataset]); got != tt.want {
+			t.Errorf("%s back end got %d %s workloads, want %d", tt.sink, got, tt.dataset, tt.want)
+		}
+	}
+	if len(sinks["default"].stats) != 1 || len(sinks["team"].stats) != 0 || len(sinks["system"].stats) != 0 {
+		t.Error("cluster stats not written to the default back end only")
+	}
+}
+
+func TestRoutingWriterRouteDown(t *testing.T) {
+	ctx := context.Background()
+	def := &countingSink{recordingSink: newRecordingSink()}
+	team := &countingSink{recordingSink: newRecordingSink()}
+	team.fail = errors.New("team bucket down")
+	rt, err := newRoute(routeConfig{Datasets: []string{"team_*"}, Backends: []string{"team"}})
+	if err != nil {
+		t.Fatalf("newRoute failed: %v", err)
+	}
+	gc := globalConfig{ProcessorMaxRetries: 3, ProcessorRetryIntvl: 1}
+	r := newRoutingWriter(newFanoutWriter([]string{"default", "team"}, []DBWriter{def, team}, gc),
+		"test", []string{"default"}, []route{rt})
+
+	// the failing route neither fails the write nor has the default back end
+	// written again
+	for _, ds := range []DsInfoEntry{{ID: 1, Name: "team_users"}, {ID: 2, Name: "nfs_users"}} {
+		if err := writePPStats(ctx, &Cluster{}, r, ds, spoolBatch(100), gc); err != nil {
+			t.Errorf("writePPStats for %s failed: %v", ds.Name, err)
+		}
+	}
+	if got := def.attempts.Load(); got != 1 {
+		t.Errorf("default back end written %d times, want 1", got)
+	}
+	if got := team.attempts.Load(); got != 1 {
+		t.Errorf("failing routed back end tried %d times, want 1", got)
+	}
+
+	// if nothing could be written, the write fails
+	def.mu.Lock()
+	def.fail = errors.New("default down")
+	def.mu.Unlock()
+	if err := r.WritePPStats(ctx, DsInfoEntry{ID: 2, Name: "nfs_users"}, spoolBatch(101)); !errors.Is(err, def.fail) {
+		t.Errorf("WritePPStats error = %v, want %v", err, def.fail)
+	}
+
+	// the routed workloads were queued, and are written once the back end
+	// recovers
+	def.mu.Lock()
+	def.fail = nil
+	def.mu.Unlock()
+	team.mu.Lock()
+	team.fail = nil
+	team.mu.Unlock()
+	waitFor(t, 5*time.Second, func() bool { return !r.targets[1].down() })
+	team.mu.Lock()
+	defer team.mu.Unlock()
+	if got := len(team.written["team_users"]); got != 1 {
+		t.Errorf("routed back end wrote %d workloads after recovering, want 1", got)
+	}
+}
+
+func TestNewStatsSinkRoutes(t *testing.T) {
+	c := &Cluster{ClusterName: "prod1"}
+	config := &tomlConfig{
+		Global:   globalConfig{Processor: discardPluginName},
+		Clusters: []clusterConf{{Hostname: "prod1.example.com"}},
+		Routes: []routeConfig{
+			{Clusters: []string{"test*"}, Backends: []string{influxPluginName}},
+			{Datasets: []string{"System"}, Backends: []string{promPluginName}},
+			{Clusters: []string{"prod1.example.com"}, Backends: []string{influxV2PluginName}},
+			{Datasets: []string{"nfs_*"}, Backends: []string{influxPluginName}},
+		},
+	}
+	ss, err := newStatsSink(c, config, 0)
+	if err != nil {
+		t.Fatalf("newStatsSink failed: %v", err)
+	}
+	r, ok := ss.(*routingWriter)
+	if !ok {
+		t.Fatalf("newStatsSink returned %T, want a routingWriter", ss)
+	}
+	// the first route is for other clusters, and the third matches everything,
+	// so neither the later route nor the default back end is used
+	var got []string
+	for _, tg := range r.fanoutWriter.targets {
+		got = append(got, tg.name)
+	}
+	if want := []string{promPluginName, influxV2PluginName}; !slices.Equal(got, want) || len(r.routes) != 2 {
+		t.Errorf("back ends %v with %d routes, want %v with 2", got, len(r.routes), want)
+	}
+	if len(r.cluster) != 1 || r.cluster[0].name != influxV2PluginName {
+		t.Error("cluster stats not routed to the back end of the cluster-wide route")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// sessionPool holds connected clusters between collector runs so that their
+// sessions can be reused after a config reload instead of creating a new
+// session each time. Clusters that are not reused are logged out.
+type sessionPool struct {
+	mu       sync.Mutex
+	clusters map[string]*Cluster // keyed by configured hostname
+}
+
+func newSessionPool() *sessionPool {
+	return &sessionPool{clusters: make(map[string]*Cluster)}
+}
+
+// take looks for a pooled cluster with the same connection settings as c and,
+// if one is found, transfers its session to c and returns true. A pooled
+// cluster for the same hostname with different settings is logged out.
+func (p *sessionPool) take(ctx context.Context, c *Cluster) bool {
+	p.mu.Lock()
+	old, ok := p.clusters[c.Hostname]
+	delete(p.clusters, c.Hostname)
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if !c.sameConnSettings(old) {
+		logout(ctx, old)
+		return false
+	}
+	c.adoptSession(old)
+	log.Info("Reusing existing session for cluster", slog.String("cluster", c.ClusterName))
+	return true
+}
+
+// release is called when a collector finishes with a connected cluster. If
+// the collector was cancelled, e.g. for a config reload, the cluster is kept
+// for possible reuse, otherwise it is logged out.
+func (p *sessionPool) release(ctx context.Context, c *Cluster) {
+	if ctx.Err() == nil {
+		logout(ctx, c)
+		return
+	}
+	p.mu.Lock()
+	old := p.clusters[c.Hostname]
+	p.clusters[c.Hostname] = c
+	p.mu.Unlock()
+	if old != nil {
+		logout(ctx, old)
+	}
+}
+
+// prune logs out every pooled cluster that cannot be reused with the given
+// config. If session reuse is disabled, that is all of them.
+func (p *sessionPool) prune(ctx context.Context, conf *tomlConfig) {
+	keep := make(map[string]bool)
+	if conf.Global.ReuseSessions {
+		for _, cc := range conf.Clusters {
+			if !cc.Disabled {
+				keep[cc.Hostname] = true
+			}
+		}
+	}
+	p.mu.Lock()
+	var stale []*Cluster
+	for host, c := range p.clusters {
+		if !keep[host] {
+			stale = append(stale, c)
+			delete(p.clusters, host)
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range stale {
+		logout(ctx, c)
+	}
+}
+
+// closeAll logs out every pooled cluster
+func (p *sessionPool) closeAll(ctx context.Context) {
+	p.prune(ctx, &tomlConfig{})
+}
+
+// logout logs out of the cluster session, logging any failure
+func logout(ctx context.Context, c *Cluster) {
+	if err := c.Logout(ctx); err != nil {
+		log.Warn("Unable to delete session for cluster", slog.String("cluster", c.name()), slog.Any("error", err))
+	}
+}
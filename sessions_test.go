@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionPool(t *testing.T) {
+	ctx := context.Background()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	connect := func(t *testing.T, f *fakePAPI) *Cluster {
+		t.Helper()
+		c := f.cluster(authtypeSession)
+		if err := c.Connect(ctx); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		return c
+	}
+
+	t.Run("reuse with unchanged settings", func(t *testing.T) {
+		f := newFakePAPI(t)
+		p := newSessionPool()
+		p.release(cancelled, connect(t, f))
+		c := f.cluster(authtypeSession)
+		if !p.take(ctx, c) {
+			t.Fatal("expected pooled session to be reused")
+		}
+		if _, err := c.GetDataSetInfo(ctx); err != nil {
+			t.Fatalf("GetDataSetInfo with reused session failed: %v", err)
+		}
+		if c.ClusterName != "fakecluster" {
+			t.Errorf("ClusterName = %q, want fakecluster", c.ClusterName)
+		}
+		if got := f.hitCount(http.MethodPost, sessionPath); got != 1 {
+			t.Errorf("logins = %d, want 1", got)
+		}
+	})
+
+	t.Run("changed settings log out", func(t *testing.T) {
+		f := newFakePAPI(t)
+		p := newSessionPool()
+		p.release(cancelled, connect(t, f))
+		c := f.cluster(authtypeSession)
+		c.RequestTimeout = time.Minute
+		if p.take(ctx, c) {
+			t.Fatal("expected session with different settings not to be reused")
+		}
+		if got := f.sessionCount(); got != 0 {
+			t.Errorf("sessions = %d, want 0", got)
+		}
+	})
+
+	t.Run("collector exit logs out", func(t *testing.T) {
+		f := newFakePAPI(t)
+		p := newSessionPool()
+		p.release(ctx, connect(t, f))
+		if got := f.sessionCount(); got != 0 {
+			t.Errorf("sessions = %d, want 0", got)
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		f := newFakePAPI(t)
+		p := newSessionPool()
+		c := connect(t, f)
+		p.release(cancelled, c)
+		conf := &tomlConfig{
+			Global:   globalConfig{ReuseSessions: true},
+			Clusters: []clusterConf{{Hostname: c.Hostname}},
+		}
+		p.prune(ctx, conf)
+		if got := f.sessionCount(); got != 1 {
+			t.Errorf("sessions after prune with reuse = %d, want 1", got)
+		}
+		conf.Global.ReuseSessions = false
+		p.prune(ctx, conf)
+		if got := f.sessionCount(); got != 0 {
+			t.Errorf("sessions after prune without reuse = %d, want 0", got)
+		}
+	})
+
+	t.Run("close all", func(t *testing.T) {
+		f := newFakePAPI(t)
+		p := newSessionPool()
+		p.release(cancelled, connect(t, f))
+		p.closeAll(cancelled)
+		if got := f.sessionCount(); got != 0 {
+			t.Errorf("sessions = %d, want 0", got)
+		}
+	})
+}
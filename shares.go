@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const smbSharePath = "/platform/1/protocols/smb/shares"
+
+// SMBShare contains the fields of an SMB share definition that we use
+type SMBShare struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Zone string `json:"zone"`
+}
+
+// GetShares returns every SMB share in the given access zone, or in the
+// default zone if zone is empty
+func (c *Cluster) GetShares(ctx context.Context, zone string) ([]SMBShare, error) {
+	path := smbSharePath
+	if zone != "" {
+		path += "?zone=" + url.QueryEscape(zone)
+	}
+	return listAll[SMBShare](ctx, c, path, "shares")
+}
+
+// shareKey identifies an SMB share within an access zone. A zone may be
+// identified by name or, with an empty zone name, by zone id. Share names are
+// case-insensitive so are stored in lower case.
+type shareKey struct {
+	zone   string
+	zoneID int
+	name   string
+}
+
+// shareCache is a per-cluster cache of the SMB shares in every access zone
+type shareCache = lookupCache[shareKey, SMBShare]
+
+func newShareCache(ttl time.Duration) *shareCache {
+	return newLookupCache("SMB shares", ttl, loadShares)
+}
+
+// loadShares lists the SMB shares in every access zone, indexing each share
+// by both zone name and zone id
+func loadShares(ctx context.Context, c *Cluster) (map[shareKey]SMBShare, error) {
+	shares := make(map[shareKey]SMBShare)
+	for _, zone := range c.zonesForLookup(ctx) {
+		zoneShares, err := c.GetShares(ctx, zone.Name)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", zone.Name, err)
+		}
+		for _, share := range zoneShares {
+			name := strings.ToLower(share.Name)
+			shares[shareKey{zone: zone.Name, name: name}] = share
+			shares[shareKey{zoneID: zone.ZoneID, name: name}] = share
+		}
+	}
+	return shares, nil
+}
+
+// shareKeyForPPStat returns the key to look up the SMB share of a workload.
+// Workloads without a zone are assumed to be in the System zone.
+func shareKeyForPPStat(ppstat PPStatResult) shareKey {
+	name := strings.ToLower(*ppstat.ShareName)
+	switch {
+	case ppstat.ZoneName != nil:
+		return shareKey{zone: *ppstat.ZoneName, name: name}
+	case ppstat.ZoneID != nil:
+		return shareKey{zoneID: *ppstat.ZoneID, name: name}
+	}
+	return shareKey{zone: "System", name: name}
+}
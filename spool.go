@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default spool limits
+const (
+	defaultSpoolMaxSize = 1024   // MiB per spool
+	defaultSpoolMaxAge  = 604800 // seconds (7 days)
+)
+
+const (
+	spoolFileSuffix = ".spool"
+	// spoolRetryIntvl is how long the back end is left alone after a failed
+	// write before the spool is replayed
+	spoolRetryIntvl = 30 * time.Second
+	// spoolReplayBatch limits the number of spooled batches replayed per write
+	spoolReplayBatch = 100
+)
+
+// spoolKind is the DBWriter method a spooled batch is written with
+type spoolKind int
+
+const (
+	spoolPPStats spoolKind = iota
+	spoolClusterStats
+)
+
+// spoolRecord is a spooled batch, stored JSON-encoded and gzip-compressed.
+// JSON keeps the difference between a missing optional field of a workload
+// and one set to its zero value, e.g. user id 0.
+type spoolRecord struct {
+	Kind         spoolKind      `json:"kind"`
+	Dataset      DsInfoEntry    `json:"dataset"`
+	PPStats      []PPStatResult `json:"ppstats,omitempty"`
+	ClusterStats []ClusterStat  `json:"cluster_stats,omitempty"`
+}
+
+// spoolFile is a spooled batch on disk
+type spoolFile struct {
+	seq     uint64
+	size    int64
+	modTime time.Time
+}
+
+// spoolWriter is a DBWriter that wraps another and keeps a write-ahead spool
+// of the batches it fails to write in a directory. Failed batches are not
+// retried directly; they are written to the spool and replayed in order once
+// the back end accepts writes again, and while the spool holds any batches,
+// new batches are added to it so that the order is kept. The spool is limited
+// in total size and in age, dropping the oldest batches first, and survives
+// restarts of the collector.
+//
+// Every batch is numbered when it is written, and spooled under its number,
+// so a batch that fails while others are being written still takes its place
+// in the order. Batches are only sent directly while the spool is empty, and
+// the spool is only replayed while no direct send is in flight, one batch at
+// a time; the mutex is never held while the back end is written to.
+type spoolWriter struct {
+	DBWriter
+	cluster    string
+	dir        string
+	maxSize    int64
+	maxAge     time.Duration
+	retryIntvl time.Duration
+
+	mu        sync.Mutex
+	files     []spoolFile // oldest first
+	size      int64
+	seq       uint64    // number of the newest batch
+	retryAt   time.Time // no replay before this time
+	inflight  int       // number of batches being sent directly
+	replaying bool
+}
+
+// newSpoolWriter returns a spoolWriter for the back end w, spooling in dir.
+// Batches left in dir by a previous run are replayed first.
+func newSpoolWriter(w DBWriter, cluster string, dir string, maxSize int64, maxAge time.Duration) (*spoolWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spool directory: %w", err)
+	}
+	s := &spoolWriter{
+		DBWriter:   w,
+		cluster:    cluster,
+		dir:        dir,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		retryIntvl: spoolRetryIntvl,
+	}
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolFileSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read spool directory: %w", err)
+		}
+		s.files = append(s.files, spoolFile{seq: seq, size: info.Size(), modTime: info.ModTime()})
+		s.size += info.Size()
+		s.seq = max(s.seq, seq)
+	}
+	slices.SortFunc(s.files, func(a, b spoolFile) int { return cmp.Compare(a.seq, b.seq) })
+	if len(s.files) > 0 {
+		log.Log(context.Background(), LevelNotice, "Found spooled batches to replay",
+			slog.String("cluster", cluster),
+			slog.Int("batches", len(s.files)),
+			slog.Int64("bytes", s.size))
+	}
+	return s, nil
+}
+
+// WritePPStats writes the workloads to the back end, or to the spool if that fails
+func (s *spoolWriter) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	return s.write(ctx, spoolRecord{Kind: spoolPPStats, Dataset: ds, PPStats: stats})
+}
+
+// WriteClusterStats writes the stats to the back end, or to the spool if that fails
+func (s *spoolWriter) WriteClusterStats(ctx context.Context, stats []ClusterStat) error {
+	return s.write(ctx, spoolRecord{Kind: spoolClusterStats, ClusterStats: stats})
+}
+
+// write sends the batch to the back end if the spool is empty, otherwise
+// spools it. An error is only returned if the batch cannot be spooled either.
+func (s *spoolWriter) write(ctx context.Context, rec spoolRecord) error {
+	s.replay(ctx)
+
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	direct := len(s.files) == 0 && !s.replaying
+	if direct {
+		s.inflight++
+	}
+	s.mu.Unlock()
+	if !direct {
+		return s.spool(seq, rec)
+	}
+
+	err := s.send(ctx, rec)
+	if err != nil {
+		log.Warn("Back end write failed, spooling batch",
+			slog.String("cluster", s.cluster),
+			slog.Any("error", err))
+		// spool the batch before it stops counting as in flight, so that it
+		// is replayed in its place
+		err = s.spool(seq, rec)
+		s.mu.Lock()
+		s.retryAt = time.Now().Add(s.retryIntvl)
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+	return err
+}
+
+// send writes a batch to the wrapped back end
+func (s *spoolWriter) send(ctx context.Context, rec spoolRecord) error {
+	if rec.Kind == spoolClusterStats {
+		return s.DBWriter.WriteClusterStats(ctx, rec.ClusterStats)
+	}
+	return s.DBWriter.WritePPStats(ctx, rec.Dataset, rec.PPStats)
+}
+
+// replay writes up to spoolReplayBatch spooled batches to the back end, oldest
+// first. It does nothing if the spool is already being replayed, a batch is
+// being sent directly, or the retry time has not been reached.
+func (s *spoolWriter) replay(ctx context.Context) {
+	s.mu.Lock()
+	s.expire()
+	if len(s.files) == 0 || s.replaying || s.inflight > 0 || time.Now().Before(s.retryAt) {
+		s.mu.Unlock()
+		return
+	}
+	s.replaying = true
+	s.mu.Unlock()
+
+	replayed := 0
+	for replayed < spoolReplayBatch {
+		s.mu.Lock()
+		if len(s.files) == 0 {
+			s.mu.Unlock()
+			break
+		}
+		f := s.files[0]
+		s.mu.Unlock()
+
+		rec, err := s.read(f)
+		if errors.Is(err, os.ErrNotExist) {
+			// dropped from the full spool while it was being replayed
+		} else if err != nil {
+			log.Warn("Dropping unreadable spooled batch",
+				slog.String("cluster", s.cluster),
+				slog.String("file", s.path(f.seq)),
+				slog.Any("error", err))
+		} else if err := s.send(ctx, rec); err != nil {
+			log.Warn("Back end write failed, will replay spool later",
+				slog.String("cluster", s.cluster),
+				slog.Any("error", err))
+			s.mu.Lock()
+			s.retryAt = time.Now().Add(s.retryIntvl)
+			s.mu.Unlock()
+			break
+		}
+		s.mu.Lock()
+		s.remove(f.seq)
+		s.mu.Unlock()
+		replayed++
+	}
+
+	s.mu.Lock()
+	s.replaying = false
+	remaining := len(s.files)
+	s.mu.Unlock()
+	if replayed > 0 {
+		log.Info("Replayed spooled batches",
+			slog.String("cluster", s.cluster),
+			slog.Int("replayed", replayed),
+			slog.Int("remaining", remaining))
+	}
+}
+
+// spool adds a batch to the spool under its number, dropping the oldest
+// batches if the spool is then over its size limit
+func (s *spoolWriter) spool(seq uint64, rec spoolRecord) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(rec); err != nil {
+		return fmt.Errorf("unable to encode batch for spool: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("unable to encode batch for spool: %w", err)
+	}
+
+	// write to a temporary file first so that a crash never leaves a partial batch
+	tmp := s.path(seq) + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write spool file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path(seq)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write spool file: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := spoolFile{seq: seq, size: int64(buf.Len()), modTime: time.Now()}
+	i, _ := slices.BinarySearchFunc(s.files, seq, func(f spoolFile, seq uint64) int { return cmp.Compare(f.seq, seq) })
+	s.files = slices.Insert(s.files, i, f)
+	s.size += f.size
+
+	dropped := 0
+	for s.size > s.maxSize && len(s.files) > 0 {
+		s.remove(s.files[0].seq)
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warn("Spool is full, dropped oldest batches",
+			slog.String("cluster", s.cluster),
+			slog.Int("dropped", dropped),
+			slog.Int64("max_size", s.maxSize))
+	}
+	return nil
+}
+
+// expire drops spooled batches older than the age limit
+func (s *spoolWriter) expire() {
+	cutoff := time.Now().Add(-s.maxAge)
+	dropped := 0
+	for len(s.files) > 0 && s.files[0].modTime.Before(cutoff) {
+		s.remove(s.files[0].seq)
+		dropped++
+	}
+	if dropped > 0 {
+		log.Warn("Dropped expired spooled batches",
+			slog.String("cluster", s.cluster),
+			slog.Int("dropped", dropped),
+			slog.Duration("max_age", s.maxAge))
+	}
+}
+
+// remove deletes a spooled batch, if it is still in the spool
+func (s *spoolWriter) remove(seq uint64) {
+	i := slices.IndexFunc(s.files, func(f spoolFile) bool { return f.seq == seq })
+	if i < 0 {
+		return
+	}
+	if err := os.Remove(s.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn("Unable to remove spool file", slog.String("cluster", s.cluster), slog.Any("error", err))
+	}
+	s.size -= s.files[i].size
+	s.files = slices.Delete(s.files, i, i+1)
+}
+
+// read decodes a spooled batch
+func (s *spoolWriter) read(f spoolFile) (spoolRecord, error) {
+	var rec spoolRecord
+	b, err := os.ReadFile(s.path(f.seq))
+	if err != nil {
+		return rec, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return rec, err
+	}
+	err = json.NewDecoder(zr).Decode(&rec)
+	return rec, err
+}
+
+func (s *spoolWriter) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolFileSuffix))
+}
+
+// writeFileSync writes data to a new file and flushes it to disk
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// spoolDirName returns the name of the spool subdirectory for a cluster
+func spoolDirName(hostname string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, hostname)
+}
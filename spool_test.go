@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// spoolBatch returns a batch of workloads with the given sample time
+func spoolBatch(sampleTime int64) []PPStatResult {
+	return []PPStatResult{{Node: 1, UnixTime: sampleTime, Username: strPtr("alice")}}
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	ss := newRecordingSink()
+	s, err := newSpoolWriter(ss, "test", dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolWriter failed: %v", err)
+	}
+
+	// while the back end is down, batches are spooled
+	ss.fail = errors.New("backend down")
+	for i := range 3 {
+		if err := s.WritePPStats(ctx, ds, spoolBatch(int64(100+i))); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+	}
+	if err := s.WriteClusterStats(ctx, []ClusterStat{{Name: "node_up", Value: 1, Time: 100}}); err != nil {
+		t.Fatalf("WriteClusterStats failed: %v", err)
+	}
+	if got := len(spoolFiles(t, dir)); got != 4 {
+		t.Fatalf("spooled %d batches, want 4", got)
+	}
+
+	// the spool survives a restart, and is replayed in order before new batches
+	// once the back end is back
+	s, err = newSpoolWriter(ss, "test", dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolWriter failed: %v", err)
+	}
+	ss.fail = nil
+	if err := s.WritePPStats(ctx, ds, spoolBatch(103)); err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+	var times []int64
+	for _, r := range ss.written["nfs_users"] {
+		times = append(times, r.UnixTime)
+	}
+	if len(times) != 4 || times[0] != 100 || times[1] != 101 || times[2] != 102 || times[3] != 103 {
+		t.Errorf("written sample times %v, want [100 101 102 103]", times)
+	}
+	if len(ss.stats) != 1 || ss.stats[0].Name != "node_up" {
+		t.Errorf("replayed cluster stats %+v, want one node_up stat", ss.stats)
+	}
+	if got := len(spoolFiles(t, dir)); got != 0 {
+		t.Errorf("%d batches left in spool, want 0", got)
+	}
+
+	t.Run("retry interval", func(t *testing.T) {
+		ss.fail = errors.New("backend down")
+		if err := s.WritePPStats(ctx, ds, spoolBatch(104)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		// the back end is not tried again until the retry interval has passed
+		ss.fail = nil
+		if err := s.WritePPStats(ctx, ds, spoolBatch(105)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		if got := len(spoolFiles(t, dir)); got != 2 {
+			t.Fatalf("spooled %d batches, want 2", got)
+		}
+		s.retryAt = time.Time{}
+		if err := s.WritePPStats(ctx, ds, spoolBatch(106)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		if got := len(ss.written["nfs_users"]); got != 7 {
+			t.Errorf("wrote %d workloads, want 7", got)
+		}
+	})
+}
+
+func TestSpoolWriterLimits(t *testing.T) {
+	ctx := context.Background()
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	ss := newRecordingSink()
+	ss.fail = errors.New("backend down")
+
+	t.Run("size", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := newSpoolWriter(ss, "test", dir, 1<<20, time.Hour)
+		if err != nil {
+			t.Fatalf("newSpoolWriter failed: %v", err)
+		}
+		if err := s.WritePPStats(ctx, ds, spoolBatch(100)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		// room for two batches
+		s.maxSize = s.size*2 + s.size/2
+		for i := range 3 {
+			if err := s.WritePPStats(ctx, ds, spoolBatch(int64(101+i))); err != nil {
+				t.Fatalf("WritePPStats failed: %v", err)
+			}
+		}
+		files := spoolFiles(t, dir)
+		if len(files) != 2 || filepath.Base(files[0]) != filepath.Base(s.path(3)) {
+			t.Errorf("spool holds %v, want the newest two batches", files)
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := newSpoolWriter(ss, "test", dir, 1<<20, time.Hour)
+		if err != nil {
+			t.Fatalf("newSpoolWriter failed: %v", err)
+		}
+		for i := range 2 {
+			if err := s.WritePPStats(ctx, ds, spoolBatch(int64(100+i))); err != nil {
+				t.Fatalf("WritePPStats failed: %v", err)
+			}
+		}
+		old := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(s.path(1), old, old); err != nil {
+			t.Fatal(err)
+		}
+		// reopen to pick up the file times
+		if s, err = newSpoolWriter(ss, "test", dir, 1<<20, time.Hour); err != nil {
+			t.Fatalf("newSpoolWriter failed: %v", err)
+		}
+		if err := s.WritePPStats(ctx, ds, spoolBatch(102)); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+		files := spoolFiles(t, dir)
+		if len(files) != 2 || filepath.Base(files[0]) != filepath.Base(s.path(2)) {
+			t.Errorf("spool holds %v, want the expired batch dropped", files)
+		}
+	})
+}
+
+func TestSpoolWriterKeepsZeroValues(t *testing.T) {
+	ctx := context.Background()
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	ss := newRecordingSink()
+	s, err := newSpoolWriter(ss, "test", t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolWriter failed: %v", err)
+	}
+	ss.fail = errors.New("backend down")
+	batch := []PPStatResult{{Node: 1, UnixTime: 100, UserID: ptr(0), GroupID: ptr(0), Username: strPtr("")}}
+	if err := s.WritePPStats(ctx, ds, batch); err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+	ss.fail = nil
+	s.retryAt = time.Time{}
+	if err := s.WritePPStats(ctx, ds, spoolBatch(101)); err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+	written := ss.written["nfs_users"]
+	if len(written) != 2 {
+		t.Fatalf("wrote %d workloads, want 2", len(written))
+	}
+	r := written[0]
+	if r.UserID == nil || *r.UserID != 0 || r.GroupID == nil || *r.GroupID != 0 || r.Username == nil || *r.Username != "" {
+		t.Errorf("replayed workload %+v lost its zero-valued fields", r)
+	}
+	if r.GroupName != nil || r.ExportID != nil {
+		t.Errorf("replayed workload %+v gained fields", r)
+	}
+}
+
+// blockingSink is a recordingSink whose writes wait on release once entered
+// has been signalled
+type blockingSink struct {
+	*recordingSink
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error {
+	select {
+	case s.entered <- struct{}{}:
+		<-s.release
+	default:
+	}
+	return s.recordingSink.WritePPStats(ctx, ds, stats)
+}
+
+func TestSpoolWriterConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	ds := DsInfoEntry{ID: 1, Name: "nfs_users"}
+	ss := &blockingSink{recordingSink: newRecordingSink(), entered: make(chan struct{}), release: make(chan struct{})}
+	s, err := newSpoolWriter(ss, "test", t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpoolWriter failed: %v", err)
+	}
+	ss.fail = errors.New("backend down")
+	for i := range 2 {
+		if err := s.WritePPStats(ctx, ds, spoolBatch(int64(100+i))); err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+	}
+	ss.fail = nil
+	s.retryAt = time.Time{}
+
+	// the first write replays the spool, and stalls in the back end
+	done := make(chan error)
+	go func() { done <- s.WritePPStats(ctx, ds, spoolBatch(102)) }()
+	<-ss.entered
+
+	// meanwhile another write is spooled rather than waiting or overtaking
+	// the replay
+	written := make(chan error)
+	go func() { written <- s.WritePPStats(ctx, ds, spoolBatch(103)) }()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("WritePPStats failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked behind the replay")
+	}
+	close(ss.release)
+	if err := <-done; err != nil {
+		t.Fatalf("WritePPStats failed: %v", err)
+	}
+
+	var times []int64
+	for _, r := range ss.written["nfs_users"] {
+		times = append(times, r.UnixTime)
+	}
+	if len(times) != 4 || times[0] != 100 || times[1] != 101 || times[2] != 103 {
+		t.Errorf("written sample times %v, want the spool replayed in order first", times)
+	}
+}
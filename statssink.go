@@ -4,10 +4,33 @@ import "context"
 
 // DBWriter defines an interface to write OneFS partitioned performance stats to a persistent store/database
 type DBWriter interface {
-	// Initialize a statssink
+	// Initialize a statssink. Init is called again with the new Cluster each
+	// time the collector reconnects; the ctx of the first call bounds the
+	// lifetime of anything the sink starts, such as a listener.
 	Init(ctx context.Context, cluster *Cluster, config *tomlConfig, ci int) error
 	// Update our current view of the defined datasets
 	UpdateDatasets(di *DsInfo)
 	// Write a set of partitioned performance stats to the sink
 	WritePPStats(ctx context.Context, ds DsInfoEntry, stats []PPStatResult) error
+	// Write a set of collector-level stats about the cluster to the sink
+	WriteClusterStats(ctx context.Context, stats []ClusterStat) error
+}
+
+// ClusterStat is a single measurement about the cluster or the collection
+// from it, as opposed to the workload stats themselves, e.g. whether a node
+// answered the last workload query
+type ClusterStat struct {
+	Name  string            // e.g. "node_up"; see clusterStatHelp
+	Tags  map[string]string // the sink adds the cluster tag
+	Value float64
+	Time  int64 // Unix time in seconds
+}
+
+// clusterStatHelp describes each of the cluster stats
+var clusterStatHelp = map[string]string{
+	"collector_restarts":  "number of times the cluster's collector has been restarted after stopping",
+	"collector_state":     "state of the cluster's collector (1 for the current state, 0 otherwise)",
+	"duplicate_samples":   "number of workloads skipped because their sample had already been written",
+	"node_up":             "whether the node returned workload data for the dataset in the last collection (1) or not (0)",
+	"performance_setting": "partitioned performance setting of the cluster",
 }
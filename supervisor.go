@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// collectorState is the state of a cluster's collector
+type collectorState int
+
+const (
+	collectorConnecting collectorState = iota
+	collectorCollecting
+	collectorBackingOff
+	collectorFailed
+)
+
+var collectorStateNames = [...]string{
+	collectorConnecting: "connecting",
+	collectorCollecting: "collecting",
+	collectorBackingOff: "backing_off",
+	collectorFailed:     "failed",
+}
+
+func (s collectorState) String() string {
+	return collectorStateNames[s]
+}
+
+// Limits on the delay before a stopped collector is restarted. A collector
+// that ran for at least the maximum delay starts again from the initial delay.
+// While the collector is not collecting, its state is written to the back end
+// every collectorStateInterval, so that back ends which expire stale samples
+// keep showing it. These are variables so that tests can shorten them.
+var (
+	collectorInitialRestartDelay = 10 * time.Second
+	collectorMaxRestartDelay     = 5 * time.Minute
+	collectorStateInterval       = 15 * time.Second
+)
+
+// errCollectorConfig is wrapped by collector errors that restarting cannot
+// fix, such as an invalid cluster configuration
+var errCollectorConfig = errors.New("configuration error")
+
+// collectorStatus is the state of one cluster's collector
+type collectorStatus struct {
+	state    collectorState
+	restarts int
+}
+
+// collectorRegistry tracks the status of every cluster's collector, keyed by
+// the cluster's configured hostname
+type collectorRegistry struct {
+	mu       sync.Mutex
+	statuses map[string]*collectorStatus
+}
+
+var collectors = &collectorRegistry{statuses: make(map[string]*collectorStatus)}
+
+func (r *collectorRegistry) status(host string) *collectorStatus {
+	st, ok := r.statuses[host]
+	if !ok {
+		st = &collectorStatus{}
+		r.statuses[host] = st
+	}
+	return st
+}
+
+// setState records and logs a change in state of the cluster's collector
+func (r *collectorRegistry) setState(host string, state collectorState) {
+	r.mu.Lock()
+	st := r.status(host)
+	changed := st.state != state
+	st.state = state
+	r.mu.Unlock()
+	if changed {
+		log.Info("Cluster collector state changed", slog.String("cluster", host), slog.String("state", state.String()))
+	}
+}
+
+// restarted counts a restart of the cluster's collector and returns the
+// total number of restarts
+func (r *collectorRegistry) restarted(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.status(host)
+	st.restarts++
+	return st.restarts
+}
+
+// get returns the status of the cluster's collector
+func (r *collectorRegistry) get(host string) collectorStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.status(host)
+}
+
+// stats returns the status of the cluster's collector as a collector_state
+// stat for each state, set to 1 for the current state and 0 for the others,
+// and a collector_restarts stat
+func (r *collectorRegistry) stats(host string) []ClusterStat {
+	st := r.get(host)
+	now := time.Now().Unix()
+	stats := make([]ClusterStat, 0, len(collectorStateNames)+1)
+	for state, name := range collectorStateNames {
+		value := 0.0
+		if collectorState(state) == st.state {
+			value = 1
+		}
+		stats = append(stats, ClusterStat{
+			Name:  "collector_state",
+			Tags:  map[string]string{"state": name},
+			Value: value,
+			Time:  now,
+		})
+	}
+	return append(stats, ClusterStat{
+		Name:  "collector_restarts",
+		Value: float64(st.restarts),
+		Time:  now,
+	})
+}
+
+// superviseCluster runs the collector for a cluster until the context is
+// cancelled. If the collector stops, e.g. because the cluster or the back end
+// is unreachable, it is restarted after a delay that doubles with each
+// consecutive failure, up to collectorMaxRestartDelay. Configuration errors
+// are not retried; they need a config reload.
+//
+// The stats sink belongs to the supervisor rather than to a run of the
+// collector, so that the collector state (collector_state and
+// collector_restarts) is still written, and the Prometheus listener still
+// serves it, while the collector is connecting, backing off or has failed.
+func superviseCluster(ctx context.Context, config *tomlConfig, ci int, pool *sessionPool) {
+	host := config.Clusters[ci].Hostname
+	var ss DBWriter // created by the first run that connects to the cluster
+	publish := func() {
+		if ss == nil {
+			return
+		}
+		if err := ss.WriteClusterStats(ctx, collectors.stats(host)); err != nil {
+			log.Warn("Unable to write collector state to back end",
+				slog.String("cluster", host),
+				slog.Any("error", err))
+		}
+	}
+	// wait writes the collector state every collectorStateInterval until t,
+	// or until ctx is cancelled, when it returns false
+	wait := func(t time.Time) bool {
+		for {
+			publish()
+			next := time.Now().Add(collectorStateInterval)
+			if t.Before(next) {
+				next = t
+			}
+			if !sleepUntil(ctx, next) {
+				return false
+			}
+			if !time.Now().Before(t) {
+				return true
+			}
+		}
+	}
+
+	delay := collectorInitialRestartDelay
+	for {
+		collectors.setState(host, collectorConnecting)
+		publish()
+		start := time.Now()
+		// each run has its own context so that everything it started is
+		// stopped before the next run; the sink lives until ctx is cancelled
+		runCtx, cancel := context.WithCancel(ctx)
+		err := statsloop(runCtx, ctx, config, ci, pool, &ss)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("collector stopped unexpectedly")
+		}
+		if errors.Is(err, errCollectorConfig) || errors.Is(err, errUnsupportedAPI) {
+			collectors.setState(host, collectorFailed)
+			log.Error("Collector for cluster failed, not restarting until the config is reloaded",
+				slog.String("cluster", host),
+				slog.Any("error", err))
+			if ss != nil {
+				// keep the failed state visible until the config is reloaded
+				for wait(time.Now().Add(collectorStateInterval)) {
+				}
+			}
+			return
+		}
+		if time.Since(start) >= collectorMaxRestartDelay {
+			delay = collectorInitialRestartDelay
+		}
+		collectors.setState(host, collectorBackingOff)
+		log.Error("Collector for cluster stopped, restarting",
+			slog.String("cluster", host),
+			slog.Any("error", err),
+			slog.Int("restarts", collectors.restarted(host)),
+			slog.Duration("restart_in", delay))
+		if !wait(time.Now().Add(delay)) {
+			return
+		}
+		delay = min(delay*2, collectorMaxRestartDelay)
+	}
+}
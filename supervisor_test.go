@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withTestCollectors gives the test its own collector registry and short
+// restart delays
+func withTestCollectors(t *testing.T) {
+	oldCollectors, oldInitial, oldMax := collectors, collectorInitialRestartDelay, collectorMaxRestartDelay
+	collectors = &collectorRegistry{statuses: make(map[string]*collectorStatus)}
+	collectorInitialRestartDelay, collectorMaxRestartDelay = 10*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		collectors, collectorInitialRestartDelay, collectorMaxRestartDelay = oldCollectors, oldInitial, oldMax
+	})
+}
+
+// fakeClusterConfig returns a config with a single cluster served by f
+func fakeClusterConfig(f *fakePAPI, processor string) *tomlConfig {
+	host, port := f.hostPort()
+	return &tomlConfig{
+		Global: globalConfig{Processor: processor, MaxRetries: 1, RetryInitialIntvl: 1, RetryMaxIntvl: 1,
+			ProcessorMaxRetries: 1, ProcessorRetryIntvl: 1},
+		Clusters: []clusterConf{{
+			Hostname: host,
+			Username: fakeUsername,
+			Password: fakePassword,
+			AuthType: authtypeBasic,
+			apiConnConfig: apiConnConfig{
+				APIPort:   ptr(port),
+				APIScheme: ptr("https"),
+			},
+		}},
+	}
+}
+
+func TestSuperviseClusterRestarts(t *testing.T) {
+	withTestCollectors(t)
+	f := newFakePAPI(t)
+	// the first run stops when the datasets cannot be listed
+	f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden,
+		Body: `{"errors":[{"code":"AEC_FORBIDDEN","message":"Privilege check failed"}]}`})
+	conf := fakeClusterConfig(f, discardPluginName)
+	host := conf.Clusters[0].Hostname
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		superviseCluster(ctx, conf, 0, newSessionPool())
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for f.hitCount(http.MethodGet, ppWorkloadPath) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the restarted collector to collect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := collectors.get(host)
+	if st.state != collectorCollecting || st.restarts != 1 {
+		t.Errorf("collector status = %v with %d restarts, want collecting with 1", st.state, st.restarts)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not exit on cancellation")
+	}
+
+	stats := collectors.stats(host)
+	for _, stat := range stats {
+		switch {
+		case stat.Name == "collector_restarts" && stat.Value != 1,
+			stat.Name == "collector_state" && (stat.Value == 1) != (stat.Tags["state"] == "collecting"):
+			t.Errorf("unexpected collector stat %+v", stat)
+		}
+	}
+	if len(stats) != len(collectorStateNames)+1 {
+		t.Errorf("got %d collector stats, want %d", len(stats), len(collectorStateNames)+1)
+	}
+}
+
+func TestSuperviseClusterConfigError(t *testing.T) {
+	withTestCollectors(t)
+	f := newFakePAPI(t)
+	conf := fakeClusterConfig(f, "nosuchbackend")
+	done := make(chan struct{})
+	go func() {
+		superviseCluster(context.Background(), conf, 0, newSessionPool())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor should not restart a collector with a configuration error")
+	}
+	if st := collectors.get(conf.Clusters[0].Hostname); st.state != collectorFailed || st.restarts != 0 {
+		t.Errorf("collector status = %v with %d restarts, want failed with 0", st.state, st.restarts)
+	}
+}
+
+// hasState reports whether the sink has been written the collector state
+func hasState(ss *recordingSink, state collectorState) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, stat := range ss.stats {
+		if stat.Name == "collector_state" && stat.Tags["state"] == state.String() && stat.Value == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSuperviseClusterWritesState(t *testing.T) {
+	withTestCollectors(t)
+	collectorInitialRestartDelay, collectorMaxRestartDelay = 200*time.Millisecond, time.Second
+	oldInterval, oldMake := collectorStateInterval, makeStatsSink
+	collectorStateInterval = 10 * time.Millisecond
+	ss := newRecordingSink()
+	makeStatsSink = func(*Cluster, *tomlConfig, int) (DBWriter, error) { return ss, nil }
+	t.Cleanup(func() { collectorStateInterval, makeStatsSink = oldInterval, oldMake })
+
+	f := newFakePAPI(t)
+	// the first run stops when the datasets cannot be listed
+	f.inject(fakeFault{Path: dsPath, Count: 1, Status: http.StatusForbidden,
+		Body: `{"errors":[{"code":"AEC_FORBIDDEN","message":"Privilege check failed"}]}`})
+	conf := fakeClusterConfig(f, discardPluginName)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		superviseCluster(ctx, conf, 0, newSessionPool())
+		close(done)
+	}()
+
+	waitFor := func(state collectorState) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !hasState(ss, state) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the %s state to be written", state)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	// the state is written while the collector backs off...
+	waitFor(collectorBackingOff)
+	// ...and once it has failed, here because the cluster turns out too old
+	f.inject(fakeFault{Path: platformLatestPath, Count: -1, Status: http.StatusOK, Body: `{"latest":"5"}`})
+	waitFor(collectorFailed)
+
+	// the failed state keeps being written until the supervisor is stopped
+	ss.mu.Lock()
+	n := len(ss.stats)
+	ss.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	ss.mu.Lock()
+	more := len(ss.stats) > n
+	ss.mu.Unlock()
+	if !more {
+		t.Error("failed state not written again")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not exit on cancellation")
+	}
+}